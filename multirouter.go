@@ -0,0 +1,71 @@
+package route
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+)
+
+// Several named Routers, like one per plugin, tried in the order they are added
+// to find which one owns a request.
+type MultiRouter struct {
+	names   []string
+	routers []*Router
+}
+
+// Add a named Router, tried after the ones already added. Names must be unique.
+func (self *MultiRouter) Add(name string, router *Router) error {
+	for _, e := range self.names {
+		if e == name {
+			return errors.New(
+				fmt.Sprintf("a Router is already named %s", name),
+			)
+		}
+	}
+	self.names = append(self.names, name)
+	self.routers = append(self.routers, router)
+	return nil
+}
+
+// Return the name of the first Router with a matching Route, the Route and the corresponding
+// parameters for a given URL object. The name is empty if no Router has a matching Route,
+// the boolean indicates if the path was matched by any of them. A Router refusing the request
+// or redirecting it owns it, see FindRoute for the error.
+func (self *MultiRouter) FindRouteFromURL(httpMethod string, urlObj *url.URL) (string, *Route, map[string]string, bool) {
+	name, match, pathMatched, _ := self.findMatch(httpMethod, urlObj)
+	if match == nil {
+		return name, nil, nil, pathMatched
+	}
+	return name, match.Route.(*Route), match.Params, pathMatched
+}
+
+// Parse the url string (complete or just the path) and return the name of the owning Router,
+// the first matching Route and the corresponding parameters. The error of a Router refusing
+// the request, like ErrRejected or a *RedirectError, is returned with its name.
+func (self *MultiRouter) FindRoute(httpMethod, urlStr string) (string, *Route, map[string]string, bool, error) {
+
+	// parse the url
+	urlObj, err := url.Parse(urlStr)
+	if err != nil {
+		return "", nil, nil, false, err
+	}
+
+	name, match, pathMatched, err := self.findMatch(httpMethod, urlObj)
+	if match == nil {
+		return name, nil, nil, pathMatched, err
+	}
+	return name, match.Route.(*Route), match.Params, pathMatched, nil
+}
+
+// try the Routers in order, and stop at the first one matching or refusing the request
+func (self *MultiRouter) findMatch(httpMethod string, urlObj *url.URL) (string, *Match, bool, error) {
+	pathMatched := false
+	for i, router := range self.routers {
+		match, matched, err := router.findMatch(httpMethod, urlObj)
+		if match != nil || err != nil {
+			return self.names[i], match, match != nil || matched, err
+		}
+		pathMatched = pathMatched || matched
+	}
+	return "", nil, pathMatched, nil
+}
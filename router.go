@@ -1,19 +1,37 @@
 package route
 
 import (
+	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
+	"net/http"
 	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type Route struct {
 
 	// Any http method. It will be used as uppercase to avoid common mistakes.
+	// "ANY" (AnyMethod) matches all the http methods.
 	HttpMethod string
 
+	// Optional, http methods this Route doesn't match, like "TRACE".
+	// Useful to narrow down an "ANY" Route.
+	ExcludeMethods []string
+
 	// A string like "/resource/:id.json".
 	// Placeholders supported are:
 	// :param that matches any char to the first '/' or '.'
+	// :param|alias that also stores the value under the alias name
+	// :param:int that only matches an integer, see FindRouteDetailed
+	// :param=other that only matches the value of the earlier :other param
 	// *splat that matches everything to the end of the string
 	// (placeholder names should be unique per PathExp)
 	PathExp string
@@ -21,26 +39,432 @@ type Route struct {
 	// Code that will be executed when this route is taken.
 	// Func http.HandlerFunc
 	Func interface{}
+
+	// Optional, restrict the Route to URLs with this scheme, like "https".
+	// The URL must be complete for the scheme to be known.
+	// A URL with another scheme doesn't count as a path match for this Route.
+	Scheme string
+
+	// Optional cache metadata, returned with the matched Route for a caching
+	// middleware to set the Cache-Control header and handle the conditional requests.
+	// The router doesn't apply them.
+	CacheControl string
+	ETagFunc     func(*http.Request) string
+
+	// Optional, time allowed to the handler, to be enforced by the caller, like with
+	// context.WithTimeout(r.Context(), route.Timeout) to keep the deadline of the parent context.
+	Timeout time.Duration
+
+	// Optional, validation of the params before Func, see Router.FindValidRoute,
+	// the caller answering with a 400 on error.
+	Validate func(params map[string]string) error
+
+	// Optional, where the Route is defined, like "routes.go:42", to find it when debugging.
+	Source string
+
+	// Optional, also match the Route under a short path, see Router.EnablePathHashing.
+	ShortPath bool
+
+	// Optional, short description of the Route for the documentation generators, see Router.Routes.
+	// The router doesn't use it.
+	Summary string
+}
+
+// Returned by FindRoute when the lookup is refused by Router.PreMatch.
+var ErrRejected = errors.New("request rejected by PreMatch")
+
+// Returned by FindRoute when the path rewriting rules keep rewriting the path,
+// see Router.EnablePathRewriting.
+var ErrRewriteLoop = errors.New("path rewriting loops")
+
+// Returned by FindRoute when the path only matches a Route with the other trailing slash form,
+// for the caller to answer with a redirect, see Router.EnableTrailingSlashNormalisation.
+type RedirectError struct {
+	// The urlencoded path to redirect to.
+	Path string
+}
+
+func (self *RedirectError) Error() string {
+	return fmt.Sprintf("redirect to %s", self.Path)
+}
+
+// return true if the error of the lookup is a *RedirectError
+func isRedirect(err error) bool {
+	_, ok := err.(*RedirectError)
+	return ok
 }
 
+// Order in which the lookup tries the branches of a Trie node, see Router.SiblingOrder.
+type SiblingOrder int
+
+const (
+	// All the matching Routes are collected and the first defined one is used.
+	DeclarationOrder SiblingOrder = iota
+	// The literal segments are tried first, then the :param=other, the :param:int,
+	// the :param and the *splat placeholders, and the first matching Route found is used.
+	LiteralFirst
+)
+
+// How the lookup picks between several matching *splat Routes, see Router.SplatResolution.
+type SplatResolution int
+
+const (
+	// The first defined *splat Route is used, like any other Route.
+	FirstDefinedSplat SplatResolution = iota
+	// The *splat Route capturing the shortest value is used, the deepest one, "/a/b/*y"
+	// over "/a/*x" for "/a/b/c" whatever their order. The first defined Route is still
+	// used when the other matching Routes don't have a splat.
+	DeepestSplat
+)
+
 type Router struct {
+
+	// How the matching Route is picked when several Routes match, DeclarationOrder by default.
+	SiblingOrder SiblingOrder
+
+	// How the matching Route is picked when several *splat Routes match, FirstDefinedSplat
+	// by default. Only used with the DeclarationOrder, LiteralFirst already tries the
+	// deepest splat first.
+	SplatResolution SplatResolution
+
+	// Add the scheme of the URL to the params of the matched Route as "_scheme".
+	CaptureScheme bool
+
+	// Ignore the trailing slash of the paths, "/x/" matching the Route of "/x", and add its
+	// presence to the params of the matched Route as "_slash", "true" or "false".
+	// The PathExps should then be defined without trailing slash.
+	CaptureTrailingSlash bool
+
+	// Count the number of times each Route is matched, see HitCounts.
+	CountPerRoute bool
+
+	// Number of literal segments a *splat PathExp must have before the splat to not be reported
+	// by Warnings as overly broad, 1 when zero. The segments with a placeholder don't count.
+	SplatWarningDepth int
+
+	// Optional, called with the http method and the urlencoded path before any lookup.
+	// When it returns false no Route is matched, and FindRoute returns ErrRejected,
+	// for the caller to answer with a 503 in maintenance mode for instance.
+	PreMatch func(method, path string) (allow bool)
+
+	// Build the Trie of the Routes starting with different literal characters concurrently,
+	// for the very large Route tables. The lookups are identical to the serial build.
+	ConcurrentBuild bool
+
 	routes                 []Route
 	disableTrieCompression bool
+	allowedSegments        map[int][]string
+	translate              func(method, path string) (string, string)
+	timeouts               map[string]time.Duration
+	defaultTimeout         time.Duration
+	methodFn               func(*http.Request) string
+	lazyCompression        bool
+	hash                   func(string) string
+	needsCompress          int32
+	compressLock           sync.Mutex
+	hosts                  map[string]*Router
+	warnings               []string
+	formats                []string
+	aliases                [][2]string
+	rewrites               []rewriteRule
+	variants               map[*Route]routeVariant
+	weightFn               func(*Route) int
+	slashNormalisation     bool
+	slashRedirect          bool
+	spaRoute               *Route
 	index                  map[*Route]int
+	stats                  []routeStats
+	statsLock              sync.RWMutex
+	pending                []TrieRoute
 	trie                   *Trie
 }
 
+// Match "/users/" with the Route of "/users", and the other way around, when the path as is
+// doesn't match any Route. With redirect, no Route is returned and FindRoute returns a
+// *RedirectError with the path of the Route instead, FindRouteDetailed and Classify return
+// the path in Redirect, and the path is not reported as matched. A path rewritten by
+// EnablePathRewriting is matched without redirect. The second lookup only happens on a miss.
+func (self *Router) EnableTrailingSlashNormalisation(redirect bool) {
+	self.slashNormalisation = true
+	self.slashRedirect = redirect
+}
+
+// return the path with the trailing slash removed, or added if there was none
+func toggledSlash(path string) string {
+	if strings.HasSuffix(path, "/") {
+		return path[:len(path)-1]
+	}
+	return path + "/"
+}
+
+// Restrict the literal segments allowed at each depth of the PathExps, depth 1 being
+// the first segment. Depths without an entry are not restricted, and segments
+// containing a placeholder are not checked. This catches typos in large route tables,
+// it must be called before SetRoutes.
+func (self *Router) RestrictSegments(allowed map[int][]string) {
+	self.allowedSegments = allowed
+}
+
 // Define the Routes. The order the Routes matters,
 // if a request matches multiple Routes, the first one will be used.
+// The Routes are copied, the Router may complete them (see EnableTimeoutByRoute).
 func (self *Router) SetRoutes(routes ...Route) error {
 
+	self.routes = append([]Route{}, routes...)
+	err := self.start()
+
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Remove all the Routes satisfying the predicate and return how many were removed.
+// The remaining Routes keep their order and their hit counts. The Routes are checked again,
+// like after a RestrictSegments, and on error they are left untouched.
+func (self *Router) RemoveMatching(predicate func(Route) bool) (int, error) {
+
+	routes := []Route{}
+	stats := []routeStats{}
+	self.statsLock.Lock()
+	for i, route := range self.routes {
+		if !predicate(route) {
+			routes = append(routes, route)
+			stats = append(stats, self.stats[i])
+		}
+	}
+	self.statsLock.Unlock()
+
+	removed := len(self.routes) - len(routes)
+	if removed == 0 {
+		return 0, nil
+	}
+
+	if err := self.replaceRoutes(routes); err != nil {
+		return 0, err
+	}
+	self.stats = stats
+
+	return removed, nil
+}
+
+// How Merge resolves two Routes with the same HttpMethod and PathExp.
+type MergePolicy int
+
+const (
+	// Keep the Route already defined in the Router.
+	PreferExisting MergePolicy = iota
+	// Replace the Route already defined by the incoming one.
+	PreferIncoming
+	// Fail the merge.
+	ErrorOnConflict
+)
+
+// Add the Routes of the other Router to this one. The Routes of this Router keep their
+// order, and the non conflicting Routes of the other Router are defined after them.
+// Conflicting Routes are resolved according to the policy. On error, the Routes are left untouched.
+func (self *Router) Merge(other *Router, policy MergePolicy) error {
+
+	routes := make([]Route, len(self.routes), len(self.routes)+len(other.routes))
+	copy(routes, self.routes)
+
+	existing := map[string]int{}
+	for i, route := range routes {
+		existing[strings.ToUpper(route.HttpMethod)+" "+route.PathExp] = i
+	}
+
+	for _, route := range other.routes {
+		i, conflict := existing[strings.ToUpper(route.HttpMethod)+" "+route.PathExp]
+		if !conflict {
+			routes = append(routes, route)
+			continue
+		}
+		switch policy {
+		case PreferExisting:
+		case PreferIncoming:
+			routes[i] = route
+		default:
+			return errors.New(
+				fmt.Sprintf("Route %s %s is defined in both Routers", route.HttpMethod, route.PathExp),
+			)
+		}
+	}
+
+	return self.replaceRoutes(routes)
+}
+
+// define the Routes, and keep the previous ones, their Trie and their hit counts if they are
+// rejected (they are not rebuilt, they may not pass the checks anymore, see RestrictSegments)
+func (self *Router) replaceRoutes(routes []Route) error {
+	previous, trie, index, variants, warnings := self.routes, self.trie, self.index, self.variants, self.warnings
+	needsCompress := atomic.LoadInt32(&self.needsCompress)
+	self.statsLock.RLock()
+	stats := self.stats
+	self.statsLock.RUnlock()
+
 	self.routes = routes
 	err := self.start()
+	if err != nil {
+		self.routes, self.trie, self.index, self.variants, self.warnings = previous, trie, index, variants, warnings
+		atomic.StoreInt32(&self.needsCompress, needsCompress)
+		self.stats = stats
+	}
+	return err
+}
+
+// Rewrite the http method and the path of the requests before the lookup, like
+// GET /v1/users/me to GET /api/internal/users/self. The path given to fn and the one it
+// returns are urlencoded. The URL object given to FindRouteFromURL is left untouched,
+// so the original method and path remain available to the caller.
+func (self *Router) EnableRequestTranslation(fn func(method, path string) (string, string)) {
+	self.translate = fn
+}
 
+// apply the request translation, if any
+func (self *Router) translated(httpMethod, path string) (string, string) {
+	if self.translate == nil {
+		return httpMethod, path
+	}
+	return self.translate(httpMethod, path)
+}
+
+// a path rewriting rule, see EnablePathRewriting
+type rewriteRule struct {
+	from *Trie
+	to   string
+}
+
+// maximum number of rewrites of a path before ErrRewriteLoop
+const maxRewrites = 10
+
+// Rewrite the paths matching the from PathExp to the to PathExp before the lookup, like
+// "/old-api/:id" to "/new-api/items/:id", the placeholders of to taking the values captured
+// by from. The rules are tried in the order they are enabled, the first matching one wins,
+// and the rewritten path is tried again against the rules, FindRoute returning ErrRewriteLoop
+// when it keeps being rewritten. When the path is rewritten, the original urlencoded path is
+// added to the params of the matched Route as "_original_path". It must be called before the lookups.
+func (self *Router) EnablePathRewriting(fromPattern, toPattern string) error {
+	if !strings.HasPrefix(fromPattern, "/") || !strings.HasPrefix(toPattern, "/") {
+		return errors.New("PathExp must start with /")
+	}
+	fromNames := placeholderNames(fromPattern)
+	for _, name := range placeholderNames(toPattern) {
+		found := false
+		for _, e := range fromNames {
+			found = found || e == name
+		}
+		if !found {
+			return errors.New(
+				fmt.Sprintf("The placeholder %s of %s is not captured by %s", name, toPattern, fromPattern),
+			)
+		}
+	}
+
+	rule := rewriteRule{from: NewTrie()}
+	fromKey, err := trieKey(fromPattern)
 	if err != nil {
 		return err
 	}
+	err = rule.from.AddRoute(AnyMethod, fromKey, fromPattern)
+	if err != nil {
+		return err
+	}
+	rule.to, err = trieKey(toPattern)
+	if err != nil {
+		return err
+	}
+
+	self.rewrites = append(self.rewrites, rule)
+	return nil
+}
+
+// apply the path rewriting rules, if any, and return the path and if it was rewritten
+func (self *Router) rewritten(httpMethod, path string) (string, bool, error) {
+	for i := 0; i <= maxRewrites; i++ {
+		rewritten := false
+		for _, rule := range self.rewrites {
+			if matches := rule.from.FindRoutes(httpMethod, path); len(matches) > 0 {
+				path = expandedPathExp(rule.to, matches[0].Params)
+				rewritten = true
+				break
+			}
+		}
+		if !rewritten {
+			return path, i > 0, nil
+		}
+	}
+	return "", false, ErrRewriteLoop
+}
+
+// return the PathExp with its placeholders replaced by the values of the params
+func expandedPathExp(pathExp string, params map[string]string) string {
+	path := ""
+	for len(pathExp) > 0 {
+		i := strings.IndexAny(pathExp, ":*")
+		if i == -1 {
+			return path + pathExp
+		}
+		path += pathExp[:i]
+		if pathExp[i] == '*' {
+			return path + params[pathExp[i+1:]]
+		}
+		var decl string
+		decl, pathExp = splitParam(pathExp[i+1:])
+		names, _, _ := parsePlaceholder(decl)
+		path += params[names[0]]
+	}
+	return path
+}
+
+// Set the Timeout of the Routes from a map of "METHOD:PathExp" to duration, like
+// "GET:/users/:id", instead of on each Route. The Routes with a Timeout already set are left
+// untouched. It must be called before SetRoutes.
+func (self *Router) EnableTimeoutByRoute(defaults map[string]time.Duration) {
+	self.timeouts = defaults
+}
+
+// Set the Timeout of all the Routes without one, after EnableTimeoutByRoute, like the
+// timeouts of an http.Server overridden per Route. It must be called before SetRoutes.
+func (self *Router) EnableRouteTimeout(timeout time.Duration) {
+	self.defaultTimeout = timeout
+}
+
+// Compress the Trie before the first lookup instead of each time the Routes are defined,
+// to batch the compression when the Routes are changed in bursts, like with RemoveMatching.
+// It must be called before SetRoutes.
+func (self *Router) EnableRouteCompression() {
+	self.lazyCompression = true
+}
 
+// compress the Trie if not done since the Routes were defined, see EnableRouteCompression
+func (self *Router) compressIfNeeded() {
+	if atomic.LoadInt32(&self.needsCompress) == 0 {
+		return
+	}
+	self.compressLock.Lock()
+	if atomic.LoadInt32(&self.needsCompress) == 1 {
+		self.trie.Compress()
+		atomic.StoreInt32(&self.needsCompress, 0)
+	}
+	self.compressLock.Unlock()
+}
+
+// Use the Routes of the sub Router for the URLs of this host, the Routes of this Router
+// are used for the other hosts. The host is taken from the URL, which must be complete;
+// server side, r.URL.Host is empty and r.Host can be copied in it before the lookup.
+// A host can only be mounted once.
+func (self *Router) MountHost(host string, sub *Router) error {
+	host = strings.ToLower(host)
+	if self.hosts == nil {
+		self.hosts = map[string]*Router{}
+	}
+	if self.hosts[host] != nil {
+		return errors.New(
+			fmt.Sprintf("host %s is already mounted", host),
+		)
+	}
+	self.hosts[host] = sub
 	return nil
 }
 
@@ -51,13 +475,313 @@ func escapedPath(urlObj *url.URL) string {
 	return parts[0]
 }
 
+// return the PathExp urlencoded, as inserted in the Trie
+func trieKey(pathExp string) (string, error) {
+	urlObj, err := url.Parse(pathExp)
+	if err != nil {
+		return "", err
+	}
+
+	// work with the PathExp urlencoded.
+	key := escapedPath(urlObj)
+
+	// make an exception for '*' used by the *splat notation
+	// and for '|' used by the :param|alias notation, only in the :param declarations
+	// (at the trie insert only)
+	key = strings.Replace(key, "%2A", "*", -1)
+	return unescapedAliases(key), nil
+}
+
+// return the urlencoded PathExp with the '|' of the :param declarations unescaped,
+// a literal '|' stays urlencoded like in the request paths
+func unescapedAliases(key string) string {
+	result := ""
+	for {
+		i := strings.IndexByte(key, ':')
+		if i == -1 {
+			return result + key
+		}
+		decl, remaining := splitParam(key[i+1:])
+		result += key[:i+1] + strings.Replace(decl, "%7C", "|", -1)
+		key = remaining
+	}
+}
+
+// check the literal segments of the PathExp against the allow-list set by RestrictSegments
+func (self *Router) checkSegments(pathExp string) error {
+	if self.allowedSegments == nil {
+		return nil
+	}
+	for i, segment := range strings.Split(pathExp, "/")[1:] {
+		allowed, ok := self.allowedSegments[i+1]
+		if !ok || segment == "" || strings.ContainsAny(segment, ":*") {
+			continue
+		}
+		found := false
+		for _, e := range allowed {
+			if e == segment {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return errors.New(
+				fmt.Sprintf("PathExp %s: segment %s is not allowed at depth %d", pathExp, segment, i+1),
+			)
+		}
+	}
+	return nil
+}
+
+// warn about the *splat of the route if it catches too many paths
+func (self *Router) checkSplat(route *Route) {
+	i := strings.IndexByte(route.PathExp, '*')
+	if i == -1 {
+		return
+	}
+	depth := self.SplatWarningDepth
+	if depth == 0 {
+		depth = 1
+	}
+	segments := 0
+	for _, segment := range strings.Split(route.PathExp[:i], "/") {
+		// a placeholder segment doesn't narrow the paths
+		if segment != "" && !strings.ContainsAny(segment, ":*") {
+			segments++
+		}
+	}
+	if segments < depth {
+		self.warnings = append(
+			self.warnings,
+			fmt.Sprintf("PathExp %s: only %d literal segments before the splat, it may match too many paths", route.PathExp, segments),
+		)
+	}
+}
+
+// Return a copy of the Routes, in the order they are tried, for introspection.
+func (self *Router) Routes() []Route {
+	return append([]Route{}, self.routes...)
+}
+
+// Return the non fatal issues found in the Routes by SetRoutes, like overly broad *splat Routes.
+func (self *Router) Warnings() []string {
+	return self.warnings
+}
+
+// A Route inserted in the Trie under another path, see Router.addVariant.
+type routeVariant struct {
+	route  *Route
+	params map[string]string
+}
+
+// insert a copy of the route in the Trie under another path, when matched the route itself is
+// returned with the additional params
+func (self *Router) addVariant(route *Route, pathExp string, params map[string]string) error {
+	variant := *route
+	err := self.insert(strings.ToUpper(route.HttpMethod), pathExp, &variant)
+	if err != nil {
+		return err
+	}
+	self.index[&variant] = self.index[route]
+	self.variants[&variant] = routeVariant{route: route, params: params}
+	return nil
+}
+
+// insert the route under the pathExp with each .:format suffix, if it takes one
+func (self *Router) addFormatVariants(route *Route, pathExp string) error {
+	if !self.takesFormat(route) {
+		return nil
+	}
+	for _, format := range self.formats {
+		err := self.addVariant(route, pathExp+"."+url.PathEscape(format), map[string]string{"format": format})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// insert the route in the Trie, or keep it for the concurrent build
+func (self *Router) insert(httpMethod, pathExp string, route *Route) error {
+	if self.ConcurrentBuild {
+		self.pending = append(self.pending, TrieRoute{httpMethod, pathExp, route})
+		return nil
+	}
+	return self.trie.AddRoute(httpMethod, pathExp, route)
+}
+
+// Order the Routes by the weight returned by weightFn, the highest first, instead of the
+// order they are defined in. Routes with the same weight keep their relative order.
+// It must be called before SetRoutes.
+func (self *Router) EnableDynamicWeights(weightFn func(*Route) int) {
+	self.weightFn = weightFn
+}
+
+// sort the routes by weight, see EnableDynamicWeights
+func (self *Router) sortByWeight() {
+	weights := make([]int, len(self.routes))
+	order := make([]int, len(self.routes))
+	for i := range self.routes {
+		weights[i] = self.weightFn(&self.routes[i])
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool {
+		return weights[order[a]] > weights[order[b]]
+	})
+	routes := make([]Route, len(self.routes))
+	for i, j := range order {
+		routes[i] = self.routes[j]
+	}
+	self.routes = routes
+}
+
+// Route the GET and HEAD requests matching no path to indexFn when the last segment of
+// their path has no file extension, like a single page application index, while paths
+// like "/app.js" are still not found, for the caller to serve them as static files.
+// The returned Route has "/*path" as PathExp, with the path captured the same way.
+// All the lookups use it, HasRoute, Classify and FindContention included.
+func (self *Router) SPAFallback(indexFn interface{}) {
+	self.spaRoute = &Route{
+		HttpMethod: "GET",
+		PathExp:    "/*path",
+		Func:       indexFn,
+	}
+}
+
+// return true if the SPA fallback applies to the request, once no path matched
+func (self *Router) spaFallback(httpMethod, path string) bool {
+	if self.spaRoute == nil || (httpMethod != "GET" && httpMethod != "HEAD") {
+		return false
+	}
+	return !strings.Contains(path[strings.LastIndexByte(path, '/')+1:], ".")
+}
+
+// return true if the SPA fallback applies to the request missing the Routes, for the lookups
+// that don't know if the path matched, in any of its trailing slash forms
+func (self *Router) spaMissFallback(httpMethod, path string, urlObj *url.URL) bool {
+	if !self.spaFallback(httpMethod, path) || self.pathMatched(path, urlObj) {
+		return false
+	}
+	return !self.slashNormalisation || path == "/" || !self.pathMatched(toggledSlash(path), urlObj)
+}
+
+// Make the alias path match the Routes of the canonical PathExp, for all their http methods,
+// like "/api/v1/users/:id" for "/users/:id". The matched Route is the canonical one, with the
+// params named after the canonical PathExp, so both must declare the same placeholders.
+// The alias also takes the .:format suffix of the canonical Routes, see WithFormatSuffix.
+// The aliases follow the Routes defined later, and the Routes are rebuilt if already defined.
+func (self *Router) EnableRouteAliasing(alias, canonical string) error {
+	if !strings.HasPrefix(alias, "/") || !strings.HasPrefix(canonical, "/") {
+		return errors.New("PathExp must start with /")
+	}
+	aliasNames := placeholderNames(alias)
+	canonicalNames := placeholderNames(canonical)
+	sort.Strings(aliasNames)
+	sort.Strings(canonicalNames)
+	if strings.Join(aliasNames, "/") != strings.Join(canonicalNames, "/") {
+		return errors.New(
+			fmt.Sprintf("An alias must declare the placeholders of its canonical PathExp: %s != %s", alias, canonical),
+		)
+	}
+	self.aliases = append(self.aliases, [2]string{alias, canonical})
+	if self.trie == nil {
+		return nil
+	}
+
+	// same Routes, keep their hit counts
+	self.statsLock.RLock()
+	stats := self.stats
+	self.statsLock.RUnlock()
+	if err := self.replaceRoutes(self.routes); err != nil {
+		self.aliases = self.aliases[:len(self.aliases)-1]
+		return err
+	}
+	self.stats = stats
+	return nil
+}
+
+// Also match the Routes with ShortPath under a short path made of the hash of their PathExp,
+// like "/u7f3k", followed by their placeholders, like "/u7f3k/:id" for "/users/:id/posts".
+// The matched Route and params are the ones of the PathExp, see ShortURLFor.
+// It must be called before SetRoutes.
+func (self *Router) EnablePathHashing(hash func(pathExp string) string) {
+	self.hash = hash
+}
+
+// return the short PathExp of a PathExp, see EnablePathHashing
+func (self *Router) shortPathExp(pathExp string) string {
+	short := self.hash(pathExp)
+	if !strings.HasPrefix(short, "/") {
+		short = "/" + short
+	}
+	for len(pathExp) > 0 {
+		i := strings.IndexAny(pathExp, ":*")
+		if i == -1 {
+			break
+		}
+		if pathExp[i] == '*' {
+			short += "/" + pathExp[i:]
+			break
+		}
+		var decl string
+		decl, pathExp = splitParam(pathExp[i+1:])
+		short += "/:" + decl
+	}
+	return short
+}
+
+// Return the short PathExp matching the Route with ShortPath of this PathExp, like "/u7f3k/:id"
+// for "/users/:id/posts", see EnablePathHashing. The Routes are identified by their PathExp.
+func (self *Router) ShortURLFor(pathExp string) (string, error) {
+	if self.hash == nil {
+		return "", errors.New("path hashing is not enabled")
+	}
+	for _, route := range self.routes {
+		if route.ShortPath && route.PathExp == pathExp {
+			return self.shortPathExp(route.PathExp), nil
+		}
+	}
+	return "", errors.New(
+		fmt.Sprintf("No Route with ShortPath for %s", pathExp),
+	)
+}
+
+// Give every Route an optional ".:format" suffix, captured in the params as "format", and
+// only matching the given formats, like "/users/:id" matching "/users/5" and "/users/5.json".
+// Routes with a *splat or already declaring a format placeholder are left untouched.
+// It must be called before SetRoutes.
+func (self *Router) WithFormatSuffix(formats ...string) {
+	self.formats = formats
+}
+
+// return true if the route gets the .:format suffix
+func (self *Router) takesFormat(route *Route) bool {
+	if len(self.formats) == 0 || strings.IndexByte(route.PathExp, '*') != -1 {
+		return false
+	}
+	for _, name := range placeholderNames(route.PathExp) {
+		if name == "format" {
+			return false
+		}
+	}
+	return true
+}
+
 // This validates the Routes and prepares the Trie data structure.
 // It must be called once the Routes are defined and before trying to find Routes.
 // The order matters, if multiple Routes match, the first defined will be used.
 func (self *Router) start() error {
 
+	if self.weightFn != nil {
+		self.sortByWeight()
+	}
+
 	self.trie = NewTrie()
 	self.index = map[*Route]int{}
+	self.variants = map[*Route]routeVariant{}
+	self.stats = make([]routeStats, len(self.routes))
+	self.warnings = []string{}
+	self.pending = nil
 
 	for i, _ := range self.routes {
 
@@ -71,20 +795,28 @@ func (self *Router) start() error {
 		if route.PathExp[0] != '/' {
 			return errors.New("PathExp must start with /")
 		}
-		urlObj, err := url.Parse(route.PathExp)
+		err := self.checkSegments(route.PathExp)
 		if err != nil {
 			return err
 		}
 
-		// work with the PathExp urlencoded.
-		pathExp := escapedPath(urlObj)
+		self.checkSplat(route)
 
-		// make an exception for '*' used by the *splat notation
-		// (at the trie insert only)
-		pathExp = strings.Replace(pathExp, "%2A", "*", -1)
+		// Timeout from the config map, or the default one
+		if route.Timeout == 0 && self.timeouts != nil {
+			route.Timeout = self.timeouts[strings.ToUpper(route.HttpMethod)+":"+route.PathExp]
+		}
+		if route.Timeout == 0 {
+			route.Timeout = self.defaultTimeout
+		}
+
+		pathExp, err := trieKey(route.PathExp)
+		if err != nil {
+			return err
+		}
 
 		// insert in the Trie
-		err = self.trie.AddRoute(
+		err = self.insert(
 			strings.ToUpper(route.HttpMethod), // work with the HttpMethod in uppercase
 			pathExp,
 			route,
@@ -95,10 +827,59 @@ func (self *Router) start() error {
 
 		// index
 		self.index[route] = i
+
+		// aliases
+		for _, alias := range self.aliases {
+			if alias[1] != route.PathExp {
+				continue
+			}
+			aliasPathExp, err := trieKey(alias[0])
+			if err != nil {
+				return err
+			}
+			err = self.addVariant(route, aliasPathExp, nil)
+			if err != nil {
+				return err
+			}
+			err = self.addFormatVariants(route, aliasPathExp)
+			if err != nil {
+				return err
+			}
+		}
+
+		// short path
+		if route.ShortPath && self.hash != nil {
+			shortPathExp, err := trieKey(self.shortPathExp(route.PathExp))
+			if err != nil {
+				return err
+			}
+			err = self.addVariant(route, shortPathExp, nil)
+			if err != nil {
+				return err
+			}
+		}
+
+		// optional .:format suffix
+		err = self.addFormatVariants(route, pathExp)
+		if err != nil {
+			return err
+		}
+	}
+
+	if self.ConcurrentBuild {
+		err := self.trie.AddRoutesConcurrently(self.pending)
+		self.pending = nil
+		if err != nil {
+			return err
+		}
 	}
 
 	if self.disableTrieCompression == false {
-		self.trie.Compress()
+		if self.lazyCompression {
+			atomic.StoreInt32(&self.needsCompress, 1)
+		} else {
+			self.trie.Compress()
+		}
 	}
 
 	return nil
@@ -121,33 +902,848 @@ func (self *Router) ofFirstDefinedRoute(matches []*Match) *Match {
 	return matchesByIndex[minIndex]
 }
 
+// return true if the constraints of the route are satisfied by the request
+func accepts(route *Route, httpMethod string, urlObj *url.URL) bool {
+	for _, method := range route.ExcludeMethods {
+		if strings.EqualFold(method, httpMethod) {
+			return false
+		}
+	}
+	return acceptsScheme(route, urlObj)
+}
+
+// accepts as a RouteFilter of the Trie
+func acceptsRoute(route interface{}, httpMethod string, urlObj *url.URL) bool {
+	return accepts(route.(*Route), httpMethod, urlObj)
+}
+
+// return true if the route has no Scheme constraint, or the one of the URL
+func acceptsScheme(route *Route, urlObj *url.URL) bool {
+	return route.Scheme == "" || strings.EqualFold(route.Scheme, urlObj.Scheme)
+}
+
+// return true if a Route of any http method matches the path and the scheme of the URL,
+// a Route skipped for its Scheme doesn't make the path matched
+func (self *Router) pathMatched(path string, urlObj *url.URL) bool {
+	for _, match := range self.trie.FindRoutesForPath(path) {
+		if acceptsScheme(match.Route.(*Route), urlObj) {
+			return true
+		}
+	}
+	return false
+}
+
+// filter in place the matches whose route constraints are satisfied
+func (self *Router) acceptedMatches(matches []*Match, httpMethod string, urlObj *url.URL) []*Match {
+	accepted := matches[:0]
+	for _, match := range matches {
+		if accepts(match.Route.(*Route), httpMethod, urlObj) {
+			accepted = append(accepted, match)
+		}
+	}
+	return accepted
+}
+
+// Outcome of the lookup of one request by Classify.
+type Result struct {
+	// PathExp of the first matching Route, empty if no Route matched.
+	PathExp string
+	// True if the path matched a Route, whatever the http method, see Route.Scheme.
+	PathMatched bool
+	// The path to redirect to, see Router.EnableTrailingSlashNormalisation.
+	Redirect string
+}
+
+// Lookup many requests in a row, like when replaying access logs against the Routes.
+// The Path of a request is taken as is, urlencoded, and its query string is ignored.
+// The params are not captured, so the lookup buffers are reused between the requests.
+// The requests are otherwise handled like by FindRoute, PreMatch and path rewriting included.
+func (self *Router) Classify(requests []struct{ Method, Path string }) []Result {
+	results := make([]Result, len(requests))
+	if self.trie == nil {
+		return results
+	}
+	self.compressIfNeeded()
+	context := newFindContext()
+	context.literalFirst = self.SiblingOrder == LiteralFirst
+	urlObj := &url.URL{}
+
+	var found, foundSplat *Route
+	var pathMatched bool
+	var splatLen int
+	context.matchFunc = func(httpMethod, path string, node *node) {
+		for _, value := range node.HttpMethodToRoute {
+			pathMatched = pathMatched || acceptsScheme(value.(*Route), urlObj)
+		}
+		for _, value := range node.methodRoutes(httpMethod) {
+			if value == nil {
+				continue
+			}
+			route := value.(*Route)
+			if !accepts(route, httpMethod, urlObj) {
+				continue
+			}
+			if context.literalFirst {
+				// the first found is the one
+				found = route
+				context.stop = true
+				return
+			}
+			if self.SplatResolution == DeepestSplat && strings.IndexByte(route.PathExp, '*') != -1 {
+				// the deepest splat, see deepestSplatMatches, the value of the splat is the last param
+				length := len(context.paramStack[len(context.paramStack)-1].value)
+				if foundSplat == nil || length < splatLen || length == splatLen && self.index[route] < self.index[foundSplat] {
+					foundSplat, splatLen = route, length
+				}
+				continue
+			}
+			if found == nil || self.index[route] < self.index[found] {
+				found = route
+			}
+		}
+	}
+
+	for i, request := range requests {
+		path := request.Path
+		if j := strings.IndexByte(path, '?'); j != -1 {
+			path = path[:j]
+		}
+		found, foundSplat = nil, nil
+		pathMatched = false
+		context.stop = false
+		if key, err := self.lookupKey(request.Method, path); err == nil {
+			requestPath := path
+			httpMethod, path := key.httpMethod, key.path
+			self.trie.root.find(httpMethod, path, context)
+
+			// then with the other trailing slash form, like findMatch
+			if found == nil && foundSplat == nil && self.slashNormalisation && path != "/" {
+				context.stop = false
+				self.trie.root.find(httpMethod, toggledSlash(path), context)
+				if (found != nil || foundSplat != nil) && self.slashRedirect && !key.rewritten {
+					results[i].Redirect = toggledSlash(requestPath)
+					found, foundSplat = nil, nil
+					continue
+				}
+			}
+
+			if found == nil && foundSplat == nil && !pathMatched && self.spaFallback(httpMethod, path) {
+				found, pathMatched = self.spaRoute, true
+			}
+		}
+		if foundSplat != nil && (found == nil || self.index[foundSplat] < self.index[found]) {
+			found = foundSplat
+		}
+		results[i].PathMatched = pathMatched
+		if found != nil {
+			results[i].PathExp = found.PathExp
+		}
+	}
+
+	return results
+}
+
 // Return the first matching Route and the corresponding parameters for a given URL object.
 func (self *Router) FindRouteFromURL(httpMethod string, urlObj *url.URL) (*Route, map[string]string, bool) {
+	match, pathMatched, _ := self.findMatch(httpMethod, urlObj)
+	if match == nil {
+		return nil, nil, pathMatched
+	}
+	return match.Route.(*Route), match.Params, pathMatched
+}
 
-	// lookup the routes in the Trie
-	matches, pathMatched := self.trie.FindRoutesAndPathMatched(
-		strings.ToUpper(httpMethod), // work with the httpMethod in uppercase
-		escapedPath(urlObj),         // work with the path urlencoded
-	)
+// Use the http method returned by fn for the lookups of FindRouteFromRequest, like the one
+// tunneled in a "_method" form field or a "X-HTTP-Method" header, instead of r.Method,
+// unless fn returns "". The GET requests are never overridden.
+func (self *Router) EnableMethodRouting(fn func(*http.Request) string) {
+	self.methodFn = fn
+}
+
+// Same as FindRouteFromURL with the http method and the URL of the request, see EnableMethodRouting.
+func (self *Router) FindRouteFromRequest(r *http.Request) (*Route, map[string]string, bool) {
+	httpMethod := r.Method
+	if self.methodFn != nil && !strings.EqualFold(httpMethod, "GET") {
+		if effective := self.methodFn(r); effective != "" {
+			httpMethod = effective
+		}
+	}
+	return self.FindRouteFromURL(httpMethod, r.URL)
+}
+
+// Returned by FindValidRoute when the Validate func of the matched Route refuses the params,
+// for the caller to answer with a 400.
+type ValidationError struct {
+	Route *Route
+	Err   error
+}
+
+func (self *ValidationError) Error() string {
+	return fmt.Sprintf("invalid params for %s %s: %s", self.Route.HttpMethod, self.Route.PathExp, self.Err)
+}
+
+// Same as FindRoute with a URL object, and then call the Validate func of the matched Route
+// with the params. The Route and the params are returned along with a *ValidationError when
+// they are refused.
+func (self *Router) FindValidRoute(httpMethod string, urlObj *url.URL) (*Route, map[string]string, bool, error) {
+	match, pathMatched, err := self.findMatch(httpMethod, urlObj)
+	if match == nil {
+		return nil, nil, pathMatched, err
+	}
+	route := match.Route.(*Route)
+	if route.Validate != nil {
+		if err := route.Validate(match.Params); err != nil {
+			return route, match.Params, pathMatched, &ValidationError{Route: route, Err: err}
+		}
+	}
+	return route, match.Params, pathMatched, nil
+}
+
+// Detailed result of a lookup, see FindRouteDetailed.
+type RouteMatch struct {
+	// The first matching Route, nil if none.
+	Route *Route
+	// The params captured for the Route.
+	Params map[string]string
+	// The values of the :param:int placeholders, already parsed, nil if none.
+	IntParams map[string]int
+	// True if the path matched a Route, whatever the http method, see Route.Scheme.
+	PathMatched bool
+	// True if the lookup was refused by Router.PreMatch.
+	Rejected bool
+	// The path to redirect to, see Router.EnableTrailingSlashNormalisation.
+	Redirect string
+}
+
+// Same as FindRouteFromURL, with the result in a struct that also carries the typed params.
+func (self *Router) FindRouteDetailed(httpMethod string, urlObj *url.URL) *RouteMatch {
+	match, pathMatched, err := self.findMatch(httpMethod, urlObj)
+	result := &RouteMatch{PathMatched: pathMatched, Rejected: err == ErrRejected}
+	if redirect, ok := err.(*RedirectError); ok {
+		result.Redirect = redirect.Path
+	}
+	if match != nil {
+		result.Route = match.Route.(*Route)
+		result.Params = match.Params
+		result.IntParams = match.IntParams
+	}
+	return result
+}
+
+// walk the Trie and return the match of the Route to use, according to the SiblingOrder
+func (self *Router) lookup(httpMethod, path string, urlObj *url.URL) (*Match, bool) {
+
+	self.compressIfNeeded()
+
+	if self.SiblingOrder == LiteralFirst {
+		match, pathMatched := self.trie.FindFirstRoute(httpMethod, path, acceptsRoute, urlObj)
+		if match == nil && pathMatched {
+			pathMatched = self.pathMatched(path, urlObj)
+		}
+		return match, pathMatched
+	}
+
+	matches, pathMatched := self.trie.FindRoutesAndPathMatched(httpMethod, path)
+
+	// drop the routes whose constraints are not satisfied
+	matches = self.acceptedMatches(matches, httpMethod, urlObj)
 
 	// short cuts
 	if len(matches) == 0 {
 		// no route found
-		return nil, nil, pathMatched
+		if pathMatched {
+			pathMatched = self.pathMatched(path, urlObj)
+		}
+		return nil, pathMatched
 	}
 
 	if len(matches) == 1 {
 		// one route found
-		return matches[0].Route.(*Route), matches[0].Params, pathMatched
+		return matches[0], pathMatched
+	}
+
+	if self.SplatResolution == DeepestSplat {
+		matches = deepestSplatMatches(matches)
 	}
 
 	// multiple routes found, pick the first defined
-	result := self.ofFirstDefinedRoute(matches)
-	return result.Route.(*Route), result.Params, pathMatched
+	return self.ofFirstDefinedRoute(matches), pathMatched
+}
+
+// filter in place the matches of splat routes having a matching splat route capturing a shorter
+// value, a deeper one whatever the length of the PathExps
+func deepestSplatMatches(matches []*Match) []*Match {
+	shortest := -1
+	for _, match := range matches {
+		if length := splatLength(match); length != -1 && (shortest == -1 || length < shortest) {
+			shortest = length
+		}
+	}
+	kept := matches[:0]
+	for _, match := range matches {
+		if length := splatLength(match); length == -1 || length == shortest {
+			kept = append(kept, match)
+		}
+	}
+	return kept
+}
+
+// return the length of the value captured by the *splat of the matched route, -1 if it has none
+func splatLength(match *Match) int {
+	pathExp := match.Route.(*Route).PathExp
+	i := strings.IndexByte(pathExp, '*')
+	if i == -1 {
+		return -1
+	}
+	return len(match.Params[pathExp[i+1:]])
+}
+
+// the http method and the path to lookup for a request, see Router.lookupKey
+type requestKey struct {
+	httpMethod string
+	path       string
+	// a trailing slash was removed, see Router.CaptureTrailingSlash
+	slash bool
+	// the path was rewritten, see Router.EnablePathRewriting
+	rewritten bool
+}
+
+// apply the PreMatch, the request translation, the path rewriting and the trailing slash
+// removal, and return the http method and the path to lookup
+func (self *Router) lookupKey(httpMethod, path string) (requestKey, error) {
+
+	if self.PreMatch != nil && !self.PreMatch(httpMethod, path) {
+		return requestKey{}, ErrRejected
+	}
+
+	httpMethod, path = self.translated(httpMethod, path)
+
+	key := requestKey{httpMethod: strings.ToUpper(httpMethod), path: path}
+
+	if len(self.rewrites) > 0 {
+		var err error
+		key.path, key.rewritten, err = self.rewritten(key.httpMethod, key.path)
+		if err != nil {
+			return requestKey{}, err
+		}
+	}
+
+	if self.CaptureTrailingSlash && len(key.path) > 1 && key.path[len(key.path)-1] == '/' {
+		key.path = key.path[:len(key.path)-1]
+		key.slash = true
+	}
+
+	// work with the httpMethod in uppercase
+	return key, nil
+}
+
+// Return true if a Route matches the http method and the URL. This is the cheapest lookup,
+// it stops at the first matching Route and doesn't capture the params.
+func (self *Router) HasRoute(httpMethod string, urlObj *url.URL) bool {
+
+	// the mounted hosts have their own Routes
+	if sub := self.hosts[strings.ToLower(urlObj.Hostname())]; sub != nil {
+		return sub.HasRoute(httpMethod, urlObj)
+	}
+
+	// no Routes of its own, only mounted hosts
+	if self.trie == nil {
+		return false
+	}
+
+	self.compressIfNeeded()
+
+	// same as escapedPath, without building the request URI
+	var path string
+	if urlObj.Opaque != "" {
+		path = escapedPath(urlObj)
+	} else if path = urlObj.EscapedPath(); path == "" {
+		path = "/"
+	}
+
+	key, err := self.lookupKey(httpMethod, path)
+	if err != nil {
+		return false
+	}
+	httpMethod, path = key.httpMethod, key.path
+
+	if self.trie.HasRoute(httpMethod, path, acceptsRoute, urlObj) {
+		return true
+	}
+
+	// the other trailing slash form, unless it is redirected
+	if self.slashNormalisation && (!self.slashRedirect || key.rewritten) && path != "/" {
+		if self.trie.HasRoute(httpMethod, toggledSlash(path), acceptsRoute, urlObj) {
+			return true
+		}
+	}
+
+	return self.spaMissFallback(httpMethod, path, urlObj)
+}
+
+// return the match of the Route to use like match, and count the hit, see CountPerRoute
+func (self *Router) findMatch(httpMethod string, urlObj *url.URL) (*Match, bool, error) {
+
+	// the mounted hosts have their own Routes and counters
+	if sub := self.hosts[strings.ToLower(urlObj.Hostname())]; sub != nil {
+		return sub.findMatch(httpMethod, urlObj)
+	}
+
+	result, pathMatched, err := self.match(httpMethod, urlObj)
+	if result != nil && result.Route != self.spaRoute && self.CountPerRoute {
+		self.countHit(result.Route.(*Route))
+	}
+	return result, pathMatched, err
+}
+
+// return the match of the Route to use, after the PreMatch and the request translation
+func (self *Router) match(httpMethod string, urlObj *url.URL) (*Match, bool, error) {
+
+	// the mounted hosts have their own Routes
+	if sub := self.hosts[strings.ToLower(urlObj.Hostname())]; sub != nil {
+		return sub.match(httpMethod, urlObj)
+	}
+
+	// no Routes of its own, only mounted hosts
+	if self.trie == nil {
+		return nil, false, nil
+	}
+
+	// work with the path urlencoded
+	key, err := self.lookupKey(httpMethod, escapedPath(urlObj))
+	if err != nil {
+		return nil, false, err
+	}
+	httpMethod, path := key.httpMethod, key.path
+
+	// lookup the routes in the Trie
+	result, pathMatched := self.lookup(httpMethod, path, urlObj)
+
+	// then with the other trailing slash form
+	if result == nil && self.slashNormalisation && path != "/" {
+		var otherMatched bool
+		result, otherMatched = self.lookup(httpMethod, toggledSlash(path), urlObj)
+		pathMatched = pathMatched || otherMatched
+		// a rewritten path is matched as is, the client can't be redirected to it
+		if result != nil && self.slashRedirect && !key.rewritten {
+			// not a 405, the path is matched under another URL
+			return nil, false, &RedirectError{Path: toggledSlash(escapedPath(urlObj))}
+		}
+	}
+
+	if result == nil {
+		if pathMatched || !self.spaFallback(httpMethod, path) {
+			// no route found
+			return nil, pathMatched, nil
+		}
+		result = &Match{Route: self.spaRoute, Params: map[string]string{"path": strings.TrimPrefix(path, "/")}}
+		pathMatched = true
+	}
+
+	// back to the Route from its variant
+	if variant, ok := self.variants[result.Route.(*Route)]; ok {
+		result.Route = variant.route
+		for name, value := range variant.params {
+			result.Params[name] = value
+		}
+	}
+
+	if self.CaptureScheme {
+		result.Params["_scheme"] = urlObj.Scheme
+	}
+
+	if key.rewritten {
+		result.Params["_original_path"] = escapedPath(urlObj)
+	}
+
+	if self.CaptureTrailingSlash {
+		result.Params["_slash"] = strconv.FormatBool(key.slash)
+	}
+
+	return result, pathMatched, nil
+}
+
+// A Route matching a request, see Router.FindContention.
+type Contender struct {
+	Route *Route
+	// Position of the Route in the Routes, -1 for the Route of Router.SPAFallback.
+	Index int
+	// The params captured for the Route.
+	Params map[string]string
+}
+
+// All the Routes matching a request, see Router.FindContention.
+type Contention struct {
+	// The Route used for the request, nil if none.
+	Winner *Contender
+	// The other Routes matching the request, in the order they are defined.
+	Losers []Contender
+}
+
+// Debug variant of FindRouteFromURL, returning the Route used for the request along with the
+// other matching Routes, to understand the lookups of overlapping Routes. The winner is picked
+// like by FindRouteFromURL, according to the SiblingOrder and the SplatResolution.
+func (self *Router) FindContention(httpMethod string, urlObj *url.URL) *Contention {
+
+	// the mounted hosts have their own Routes
+	if sub := self.hosts[strings.ToLower(urlObj.Hostname())]; sub != nil {
+		return sub.FindContention(httpMethod, urlObj)
+	}
+
+	contention := &Contention{Losers: []Contender{}}
+	if self.trie == nil {
+		return contention
+	}
+	key, err := self.lookupKey(httpMethod, escapedPath(urlObj))
+	if err != nil {
+		return contention
+	}
+	method, path := key.httpMethod, key.path
+
+	winner, _ := self.lookup(method, path, urlObj)
+	matches, _ := self.trie.FindRoutesAndPathMatched(method, path)
+	for _, match := range self.acceptedMatches(matches, method, urlObj) {
+		route := match.Route.(*Route)
+		contender := Contender{Route: route, Index: self.index[route], Params: match.Params}
+
+		// back to the Route from its variant
+		if variant, ok := self.variants[route]; ok {
+			contender.Route = variant.route
+			for name, value := range variant.params {
+				contender.Params[name] = value
+			}
+		}
+
+		if winner != nil && winner.Route == match.Route {
+			contention.Winner = &contender
+		} else {
+			contention.Losers = append(contention.Losers, contender)
+		}
+	}
+
+	// no Route matched the path, but the SPA fallback may apply
+	if contention.Winner == nil {
+		if match, _, err := self.match(httpMethod, urlObj); err == nil && match != nil {
+			route := match.Route.(*Route)
+			contention.Winner = &Contender{Route: route, Index: self.index[route], Params: match.Params}
+			if route == self.spaRoute {
+				contention.Winner.Index = -1
+			}
+		}
+	}
+
+	sort.SliceStable(contention.Losers, func(a, b int) bool {
+		return contention.Losers[a].Index < contention.Losers[b].Index
+	})
+
+	return contention
+}
+
+// Same as FindRouteFromURL, but the returned params always contain all the placeholders
+// declared by the PathExp of the Route, with an empty value for the ones absent from the URL.
+// FindRouteFromURL only returns the params actually captured.
+func (self *Router) FindRouteComplete(httpMethod string, urlObj *url.URL) (*Route, map[string]string, bool) {
+	route, params, pathMatched := self.FindRouteFromURL(httpMethod, urlObj)
+	if route == nil {
+		return nil, nil, pathMatched
+	}
+	names := placeholderNames(route.PathExp)
+	if self.takesFormat(route) {
+		names = append(names, "format")
+	}
+	for _, name := range names {
+		if _, ok := params[name]; !ok {
+			params[name] = ""
+		}
+	}
+	return route, params, pathMatched
+}
+
+// counters of a Route, see Router.CountPerRoute
+type routeStats struct {
+	hits int64
+	// UnixNano of the last match
+	lastMatched int64
+}
+
+// update the counters of the route, many lookups can do it at the same time,
+// but not while a snapshot is taken
+func (self *Router) countHit(route *Route) {
+	self.statsLock.RLock()
+	stats := &self.stats[self.index[route]]
+	atomic.AddInt64(&stats.hits, 1)
+	atomic.StoreInt64(&stats.lastMatched, time.Now().UnixNano())
+	self.statsLock.RUnlock()
+}
+
+// Return the number of times each Route has been matched, keyed by "METHOD PathExp".
+// Routes never matched are reported with 0. CountPerRoute must be enabled.
+func (self *Router) HitCounts() map[string]int64 {
+	counts := map[string]int64{}
+	for _, metric := range self.CollectMetrics() {
+		counts[metric.Method+" "+metric.Pattern] = metric.Hits
+	}
+	return counts
+}
+
+// The counters of a Route, see CollectMetrics.
+type RouteMetric struct {
+	Method  string
+	Pattern string
+	// Number of times the Route has been matched.
+	Hits int64
+	// Last time the Route has been matched, zero if never.
+	LastMatched time.Time
+}
+
+// Return the counters of all the Routes in the order they are defined, including the Routes
+// never matched. The snapshot is consistent, no lookup updates the counters while it is taken.
+// CountPerRoute must be enabled.
+func (self *Router) CollectMetrics() []RouteMetric {
+	self.statsLock.Lock()
+	defer self.statsLock.Unlock()
+	metrics := make([]RouteMetric, len(self.routes))
+	for i, route := range self.routes {
+		metrics[i] = RouteMetric{
+			Method:  strings.ToUpper(route.HttpMethod),
+			Pattern: route.PathExp,
+			Hits:    self.stats[i].hits,
+		}
+		if self.stats[i].lastMatched != 0 {
+			metrics[i].LastMatched = time.Unix(0, self.stats[i].lastMatched)
+		}
+	}
+	return metrics
+}
+
+// one line of the DumpMatches output
+type dumpedMatch struct {
+	Method  string            `json:"method"`
+	Path    string            `json:"path"`
+	PathExp string            `json:"pattern"`
+	Params  map[string]string `json:"params"`
+	Reason  string            `json:"reason"`
+	// the path to redirect to, for the "redirect" reason
+	Redirect string `json:"redirect,omitempty"`
+}
+
+// Lookup the requests and write for each one a JSON object per line with the request, the
+// PathExp of the matched Route, the params and the reason: "matched", "method_not_allowed",
+// "not_found", "rejected", "redirect" with the path to redirect to, "rewrite_loop" (see
+// EnablePathRewriting) or "invalid_url". The output is stable for a given set of Routes,
+// useful to generate golden files detecting routing regressions. The lookups are not counted,
+// see CountPerRoute.
+func (self *Router) DumpMatches(w io.Writer, requests []struct{ Method, Path string }) error {
+	encoder := json.NewEncoder(w)
+	for _, request := range requests {
+		line := dumpedMatch{Method: request.Method, Path: request.Path}
+		route, params, pathMatched, err := self.findRoute(request.Method, request.Path, self.match)
+		switch {
+		case err == ErrRejected:
+			line.Reason = "rejected"
+		case err == ErrRewriteLoop:
+			line.Reason = "rewrite_loop"
+		case isRedirect(err):
+			line.Reason = "redirect"
+			line.Redirect = err.(*RedirectError).Path
+		case err != nil:
+			line.Reason = "invalid_url"
+		case route != nil:
+			line.Reason = "matched"
+			line.PathExp = route.PathExp
+			line.Params = params
+		case pathMatched:
+			line.Reason = "method_not_allowed"
+		default:
+			line.Reason = "not_found"
+		}
+		if err := encoder.Encode(&line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Lookup the requests and return the Routes matched by at least one of them and the
+// Routes never matched, in the order they are defined. Useful to check that a test suite
+// exercises every Route. The lookups are not counted, see CountPerRoute.
+func (self *Router) Coverage(requests []struct{ Method, Path string }) (covered, uncovered []Route) {
+	hit := make([]bool, len(self.routes))
+	for _, request := range requests {
+		route, _, _, err := self.findRoute(request.Method, request.Path, self.match)
+		if err != nil || route == nil {
+			continue
+		}
+		// the Routes of the mounted hosts are not in the index
+		if i, ok := self.index[route]; ok {
+			hit[i] = true
+		}
+	}
+	covered = []Route{}
+	uncovered = []Route{}
+	for i, route := range self.routes {
+		if hit[i] {
+			covered = append(covered, route)
+		} else {
+			uncovered = append(uncovered, route)
+		}
+	}
+	return covered, uncovered
+}
+
+// Return the Routes that the lookup only reaches after trying a sibling branch, like a
+// literal segment behind a :param or a *splat, in the order they are defined.
+// Constraining or reordering these Routes keeps the lookups fast.
+func (self *Router) BacktrackingRoutes() []Route {
+	if self.trie == nil {
+		return []Route{}
+	}
+	self.compressIfNeeded()
+	flagged := make([]bool, len(self.routes))
+	self.trie.root.eachBacktrackingRoute(self.SiblingOrder == LiteralFirst, func(route interface{}) {
+		flagged[self.index[route.(*Route)]] = true
+	})
+	routes := []Route{}
+	for i, route := range self.routes {
+		if flagged[i] {
+			routes = append(routes, route)
+		}
+	}
+	return routes
+}
+
+// A Route translated for the route config of a service mesh sidecar, like Envoy or Istio.
+type MeshRule struct {
+	// The http method, empty for the "ANY" Routes.
+	Method string
+	// The http methods the Route doesn't match, see Route.ExcludeMethods.
+	ExcludeMethods []string
+	// The literal part of the PathExp, up to the first placeholder.
+	PathPrefix string
+	// A regular expression matching the same paths as the PathExp.
+	PathRegex string
+}
+
+// compile the path expression into a regular expression matching the same paths
+func pathExpRegex(pathExp string) string {
+	regex := "^"
+	for len(pathExp) > 0 {
+		i := strings.IndexAny(pathExp, ":*")
+		if i == -1 {
+			regex += regexp.QuoteMeta(pathExp)
+			break
+		}
+		regex += regexp.QuoteMeta(pathExp[:i])
+		if pathExp[i] == '*' {
+			regex += ".+"
+			break
+		}
+		var decl string
+		decl, pathExp = splitParam(pathExp[i+1:])
+		_, kind, _ := parsePlaceholder(decl)
+		switch {
+		case kind == "int":
+			regex += "[+-]?[0-9]+"
+		case pathExp == "":
+			regex += "[^/.]+"
+		default:
+			regex += "[^/.]*"
+		}
+	}
+	return regex + "$"
+}
+
+// Return the Routes as rules for a service mesh, in the order they are defined, each Route
+// followed by the rules of its aliases and its short path, see EnableRouteAliasing and
+// EnablePathHashing. The Scheme of the Routes, the PreMatch, the request translation, the path
+// rewriting and the trailing slash handling can't be expressed by the rules and are left out.
+func (self *Router) MeshRules() []MeshRule {
+	rules := []MeshRule{}
+	for i := range self.routes {
+		route := &self.routes[i]
+		rules = append(rules, self.meshRule(route, route.PathExp, self.takesFormat(route)))
+		for _, alias := range self.aliases {
+			if alias[1] == route.PathExp {
+				rules = append(rules, self.meshRule(route, alias[0], self.takesFormat(route)))
+			}
+		}
+		if route.ShortPath && self.hash != nil {
+			rules = append(rules, self.meshRule(route, self.shortPathExp(route.PathExp), false))
+		}
+	}
+	return rules
+}
+
+// return the rule of the route under the pathExp, with the optional .:format suffix
+func (self *Router) meshRule(route *Route, pathExp string, withFormat bool) MeshRule {
+	rule := MeshRule{
+		Method:         strings.ToUpper(route.HttpMethod),
+		ExcludeMethods: route.ExcludeMethods,
+		PathPrefix:     pathExp,
+		PathRegex:      pathExpRegex(pathExp),
+	}
+	if rule.Method == AnyMethod {
+		rule.Method = ""
+	}
+	if withFormat {
+		formats := []string{}
+		for _, format := range self.formats {
+			formats = append(formats, regexp.QuoteMeta(url.PathEscape(format)))
+		}
+		rule.PathRegex = strings.TrimSuffix(rule.PathRegex, "$") + `(\.(` + strings.Join(formats, "|") + `))?$`
+	}
+	if i := strings.IndexAny(pathExp, ":*"); i != -1 {
+		rule.PathPrefix = pathExp[:i]
+	}
+	return rule
+}
+
+// Return the distinct first segments of the PathExps, sorted, to shard the Routes by top level
+// segment. A segment starting with a placeholder is reported as ":" for a :param and "*" for a
+// *splat, and only the literal part before a placeholder is reported, like "v" for "/v:version".
+// The Route of "/" is reported as "". The aliases and the short paths of the Routes are included,
+// see EnableRouteAliasing and EnablePathHashing.
+func (self *Router) TopLevelSegments() []string {
+	found := map[string]bool{}
+	for _, route := range self.routes {
+		found[topLevelSegment(route.PathExp)] = true
+		for _, alias := range self.aliases {
+			if alias[1] == route.PathExp {
+				found[topLevelSegment(alias[0])] = true
+			}
+		}
+		if route.ShortPath && self.hash != nil {
+			found[topLevelSegment(self.shortPathExp(route.PathExp))] = true
+		}
+	}
+	segments := []string{}
+	for segment := range found {
+		segments = append(segments, segment)
+	}
+	sort.Strings(segments)
+	return segments
+}
+
+// return the first segment of the PathExp, see TopLevelSegments
+func topLevelSegment(pathExp string) string {
+	segment := strings.TrimPrefix(pathExp, "/")
+	if i := strings.IndexByte(segment, '/'); i != -1 {
+		segment = segment[:i]
+	}
+	if i := strings.IndexAny(segment, ":*"); i == 0 {
+		segment = segment[:1]
+	} else if i != -1 {
+		segment = segment[:i]
+	}
+	return segment
 }
 
 // Parse the url string (complete or just the path) and return the first matching Route and the corresponding parameters.
 func (self *Router) FindRoute(httpMethod, urlStr string) (*Route, map[string]string, bool, error) {
+	return self.findRoute(httpMethod, urlStr, self.findMatch)
+}
+
+// parse the url string and lookup the Route with find, findMatch or match to not count the hit
+func (self *Router) findRoute(httpMethod, urlStr string, find func(string, *url.URL) (*Match, bool, error)) (*Route, map[string]string, bool, error) {
 
 	// parse the url
 	urlObj, err := url.Parse(urlStr)
@@ -155,6 +1751,9 @@ func (self *Router) FindRoute(httpMethod, urlStr string) (*Route, map[string]str
 		return nil, nil, false, err
 	}
 
-	route, params, pathMatched := self.FindRouteFromURL(httpMethod, urlObj)
-	return route, params, pathMatched, nil
+	match, pathMatched, err := find(httpMethod, urlObj)
+	if match == nil {
+		return nil, nil, pathMatched, err
+	}
+	return match.Route.(*Route), match.Params, pathMatched, nil
 }
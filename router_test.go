@@ -0,0 +1,1558 @@
+package route
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRestrictSegments(t *testing.T) {
+
+	router := Router{}
+	router.RestrictSegments(map[int][]string{1: {"users", "posts"}})
+
+	err := router.SetRoutes(
+		Route{HttpMethod: "GET", PathExp: "/users/:id"},
+		Route{HttpMethod: "GET", PathExp: "/:lang/home"},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = router.SetRoutes(
+		Route{HttpMethod: "GET", PathExp: "/users/:id"},
+		Route{HttpMethod: "GET", PathExp: "/usres/:id"},
+	)
+	if err == nil {
+		t.Fatal("expected an error for a disallowed segment at depth 1")
+	}
+	if !strings.Contains(err.Error(), "/usres/:id") || !strings.Contains(err.Error(), "usres") {
+		t.Errorf("expected the route and the segment in the error, got: %s", err)
+	}
+}
+
+func TestSchemeConstraint(t *testing.T) {
+
+	router := Router{CaptureScheme: true}
+	err := router.SetRoutes(
+		Route{HttpMethod: "GET", PathExp: "/secure", Scheme: "https"},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	route, params, pathMatched, err := router.FindRoute("GET", "https://example.com/secure")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if route == nil || params["_scheme"] != "https" || !pathMatched {
+		t.Errorf("expected the https Route with _scheme=https, got: %v %v", route, params)
+	}
+
+	route, _, pathMatched, err = router.FindRoute("GET", "http://example.com/secure")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if route != nil {
+		t.Error("expected no Route for http")
+	}
+	if pathMatched {
+		t.Error("expected a Route skipped for its scheme not to match the path")
+	}
+}
+
+func TestClassify(t *testing.T) {
+
+	router := Router{}
+	err := router.SetRoutes(
+		Route{HttpMethod: "GET", PathExp: "/users/:id"},
+		Route{HttpMethod: "POST", PathExp: "/users"},
+		Route{HttpMethod: "GET", PathExp: "/files/*path"},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	results := router.Classify([]struct{ Method, Path string }{
+		{"GET", "/users/5?x=1"},
+		{"GET", "/users"},
+		{"GET", "/files/a/b"},
+		{"GET", "/nope"},
+	})
+	expected := []Result{
+		{PathExp: "/users/:id", PathMatched: true},
+		{PathExp: "", PathMatched: true},
+		{PathExp: "/files/*path", PathMatched: true},
+		{PathExp: "", PathMatched: false},
+	}
+	for i, result := range results {
+		if result != expected[i] {
+			t.Errorf("request %d: expected %v, got %v", i, expected[i], result)
+		}
+	}
+}
+
+// route table and requests for the lookup benchmarks
+func benchmarkRouter(b *testing.B) (*Router, []struct{ Method, Path string }) {
+	router := &Router{}
+	routes := []Route{}
+	requests := []struct{ Method, Path string }{}
+	for i := 0; i < 100; i++ {
+		routes = append(routes,
+			Route{HttpMethod: "GET", PathExp: fmt.Sprintf("/resources%d/:id", i)},
+			Route{HttpMethod: "GET", PathExp: fmt.Sprintf("/resources%d/:id/files/*path", i)},
+		)
+		requests = append(requests,
+			struct{ Method, Path string }{"GET", fmt.Sprintf("/resources%d/123", i)},
+			struct{ Method, Path string }{"GET", fmt.Sprintf("/resources%d/123/files/a/b", i)},
+		)
+	}
+	err := router.SetRoutes(routes...)
+	if err != nil {
+		b.Fatal(err)
+	}
+	return router, requests
+}
+
+func BenchmarkClassify(b *testing.B) {
+	router, requests := benchmarkRouter(b)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		router.Classify(requests)
+	}
+}
+
+func BenchmarkClassifyWithFindRoute(b *testing.B) {
+	router, requests := benchmarkRouter(b)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		for _, request := range requests {
+			router.FindRoute(request.Method, request.Path)
+		}
+	}
+}
+
+func TestMerge(t *testing.T) {
+
+	newRouters := func() (*Router, *Router) {
+		existing := &Router{}
+		existing.SetRoutes(
+			Route{HttpMethod: "GET", PathExp: "/a", Source: "existing"},
+			Route{HttpMethod: "GET", PathExp: "/b"},
+		)
+		incoming := &Router{}
+		incoming.SetRoutes(
+			Route{HttpMethod: "GET", PathExp: "/a", Source: "incoming"},
+			Route{HttpMethod: "GET", PathExp: "/c"},
+		)
+		return existing, incoming
+	}
+
+	for policy, source := range map[MergePolicy]string{PreferExisting: "existing", PreferIncoming: "incoming"} {
+		existing, incoming := newRouters()
+		err := existing.Merge(incoming, policy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		route, _, _, _ := existing.FindRoute("GET", "/a")
+		if route == nil || route.Source != source {
+			t.Errorf("expected the %s Route, got: %v", source, route)
+		}
+		for _, path := range []string{"/b", "/c"} {
+			if route, _, _, _ := existing.FindRoute("GET", path); route == nil {
+				t.Errorf("expected a Route for %s", path)
+			}
+		}
+	}
+
+	existing, incoming := newRouters()
+	if existing.Merge(incoming, ErrorOnConflict) == nil {
+		t.Error("expected an error on conflict")
+	}
+	if len(existing.Routes()) != 2 {
+		t.Errorf("expected the Routes to be untouched, got: %v", existing.Routes())
+	}
+}
+
+func TestMergeRollback(t *testing.T) {
+
+	router := &Router{}
+	router.SetRoutes(Route{HttpMethod: "GET", PathExp: "/u/:id"})
+	other := &Router{}
+	other.SetRoutes(Route{HttpMethod: "POST", PathExp: "/u/:uid"})
+
+	if router.Merge(other, PreferExisting) == nil {
+		t.Fatal("expected an error for inconsistent placeholder names")
+	}
+	if len(router.Routes()) != 1 {
+		t.Errorf("expected the previous Routes, got: %v", router.Routes())
+	}
+	if route, _, _, _ := router.FindRoute("GET", "/u/5"); route == nil {
+		t.Error("expected the previous Routes to still be routable")
+	}
+}
+
+func TestPlaceholderAliases(t *testing.T) {
+
+	router := Router{}
+	err := router.SetRoutes(
+		Route{HttpMethod: "GET", PathExp: "/users/:userID|id"},
+		Route{HttpMethod: "GET", PathExp: "/a|b"},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	route, params, _, err := router.FindRoute("GET", "/users/42")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if route == nil || params["userID"] != "42" || params["id"] != "42" {
+		t.Errorf("expected userID and id to be 42, got: %v", params)
+	}
+
+	route, _, _, err = router.FindRoute("GET", "/a|b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if route == nil || route.PathExp != "/a|b" {
+		t.Errorf("expected a literal | to match, got: %v", route)
+	}
+
+	err = router.SetRoutes(Route{HttpMethod: "GET", PathExp: "/users/:userID|id/posts/:id"})
+	if err == nil {
+		t.Error("expected an error for an alias colliding with a placeholder")
+	}
+}
+
+func TestIntPlaceholder(t *testing.T) {
+
+	router := Router{}
+	err := router.SetRoutes(
+		Route{HttpMethod: "GET", PathExp: "/users/:id:int"},
+		Route{HttpMethod: "GET", PathExp: "/users/:name"},
+		Route{HttpMethod: "GET", PathExp: "/t/:hh:mm"},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	match := router.FindRouteDetailed("GET", &url.URL{Path: "/users/42"})
+	if match.Route == nil || match.Route.PathExp != "/users/:id:int" {
+		t.Fatalf("expected the int Route, got: %v", match.Route)
+	}
+	if match.IntParams["id"] != 42 || match.Params["id"] != "42" {
+		t.Errorf("expected id to be 42, got: %v %v", match.IntParams, match.Params)
+	}
+
+	match = router.FindRouteDetailed("GET", &url.URL{Path: "/users/abc"})
+	if match.Route == nil || match.Route.PathExp != "/users/:name" || match.IntParams != nil {
+		t.Errorf("expected the string Route, got: %v", match.Route)
+	}
+
+	match = router.FindRouteDetailed("GET", &url.URL{Path: "/t/12"})
+	if match.Route == nil || match.Params["hh:mm"] != "12" {
+		t.Errorf("expected a ':' in a placeholder name to be kept, got: %v", match.Params)
+	}
+}
+
+func TestMountHost(t *testing.T) {
+
+	a := &Router{}
+	if err := a.SetRoutes(Route{HttpMethod: "GET", PathExp: "/page", Func: "a"}); err != nil {
+		t.Fatal(err)
+	}
+	b := &Router{}
+	if err := b.SetRoutes(Route{HttpMethod: "GET", PathExp: "/page", Func: "b"}); err != nil {
+		t.Fatal(err)
+	}
+
+	router := Router{}
+	if err := router.MountHost("a.example.com", a); err != nil {
+		t.Fatal(err)
+	}
+	if err := router.MountHost("B.example.com", b); err != nil {
+		t.Fatal(err)
+	}
+	if err := router.MountHost("b.example.com", a); err == nil {
+		t.Error("expected a host to be mounted only once")
+	}
+
+	for host, expected := range map[string]string{"a.example.com": "a", "b.example.com": "b"} {
+		route, _, _, err := router.FindRoute("GET", "http://"+host+"/page")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if route == nil || route.Func != expected {
+			t.Errorf("%s: expected the Route of %s, got: %v", host, expected, route)
+		}
+	}
+
+	// no Routes of its own, the other hosts miss
+	urlObj := &url.URL{Scheme: "http", Host: "c.example.com", Path: "/page"}
+	route, _, pathMatched := router.FindRouteFromURL("GET", urlObj)
+	if route != nil || pathMatched {
+		t.Errorf("expected a 404 for an unknown host, got: %v %v", route, pathMatched)
+	}
+	if router.HasRoute("GET", urlObj) {
+		t.Error("expected HasRoute to be false for an unknown host")
+	}
+	if contention := router.FindContention("GET", urlObj); contention.Winner != nil {
+		t.Errorf("expected no winner for an unknown host, got: %v", contention.Winner)
+	}
+}
+
+func TestRemoveMatching(t *testing.T) {
+
+	router := Router{CountPerRoute: true}
+	err := router.SetRoutes(
+		Route{HttpMethod: "GET", PathExp: "/admin/users"},
+		Route{HttpMethod: "GET", PathExp: "/api/users"},
+		Route{HttpMethod: "GET", PathExp: "/admin/posts"},
+		Route{HttpMethod: "GET", PathExp: "/api/posts"},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	router.FindRoute("GET", "/api/posts")
+
+	removed, err := router.RemoveMatching(func(route Route) bool {
+		return strings.HasPrefix(route.PathExp, "/admin/")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != 2 {
+		t.Errorf("expected 2 removed Routes, got: %d", removed)
+	}
+	routes := router.Routes()
+	if len(routes) != 2 || routes[0].PathExp != "/api/users" || routes[1].PathExp != "/api/posts" {
+		t.Errorf("expected the siblings to be kept in order, got: %v", routes)
+	}
+	if route, _, _, _ := router.FindRoute("GET", "/admin/users"); route != nil {
+		t.Errorf("expected the removed Route to miss, got: %v", route)
+	}
+	if hits := router.HitCounts()["GET /api/posts"]; hits != 1 {
+		t.Errorf("expected the hit counts to be kept, got: %d", hits)
+	}
+
+	// the remaining Routes are checked against the new allow-list
+	router.RestrictSegments(map[int][]string{1: {"admin"}})
+	removed, err = router.RemoveMatching(func(route Route) bool {
+		return route.PathExp == "/api/users"
+	})
+	if err == nil {
+		t.Fatal("expected an error for the remaining disallowed segment")
+	}
+	if removed != 0 || len(router.Routes()) != 2 {
+		t.Errorf("expected the Routes to be left untouched, got: %d %v", removed, router.Routes())
+	}
+	if route, _, _, _ := router.FindRoute("GET", "/api/users"); route == nil {
+		t.Error("expected the Routes to still match after the error")
+	}
+	if hits := router.HitCounts()["GET /api/posts"]; hits != 1 {
+		t.Errorf("expected the hit counts to be kept after the error, got: %d", hits)
+	}
+}
+
+func TestHasRoute(t *testing.T) {
+
+	router := Router{}
+	err := router.SetRoutes(
+		Route{HttpMethod: "GET", PathExp: "/users/:id"},
+		Route{HttpMethod: "GET", PathExp: "/files/*path"},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for path, expected := range map[string]bool{"/users/5": true, "/files/a/b": true, "/users": false, "/posts/5": false} {
+		if got := router.HasRoute("GET", &url.URL{Path: path}); got != expected {
+			t.Errorf("%s: expected %v, got %v", path, expected, got)
+		}
+	}
+	if router.HasRoute("POST", &url.URL{Path: "/users/5"}) {
+		t.Error("expected HasRoute to be false for another http method")
+	}
+}
+
+func BenchmarkHasRoute(b *testing.B) {
+	router, requests := benchmarkRouter(b)
+	urls := []*url.URL{}
+	for _, request := range requests {
+		urls = append(urls, &url.URL{Path: request.Path})
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		for _, urlObj := range urls {
+			if !router.HasRoute("GET", urlObj) {
+				b.Fatal("expected a match")
+			}
+		}
+	}
+}
+
+func TestWithFormatSuffix(t *testing.T) {
+
+	router := Router{}
+	router.WithFormatSuffix("json", "xml")
+	err := router.SetRoutes(
+		Route{HttpMethod: "GET", PathExp: "/users/:id"},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	route, params, _, err := router.FindRoute("GET", "/users/5.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if route == nil || route.PathExp != "/users/:id" || params["id"] != "5" || params["format"] != "json" {
+		t.Errorf("expected the json format, got: %v %v", route, params)
+	}
+
+	route, params, _, err = router.FindRoute("GET", "/users/5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := params["format"]; route == nil || params["id"] != "5" || ok {
+		t.Errorf("expected no format, got: %v %v", route, params)
+	}
+
+	route, _, _, _ = router.FindRoute("GET", "/users/5.csv")
+	if route != nil {
+		t.Errorf("expected an unknown format to miss, got: %v", route)
+	}
+}
+
+func TestCoverage(t *testing.T) {
+
+	router := Router{CountPerRoute: true}
+	err := router.SetRoutes(
+		Route{HttpMethod: "GET", PathExp: "/users"},
+		Route{HttpMethod: "GET", PathExp: "/users/:id"},
+		Route{HttpMethod: "POST", PathExp: "/users"},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	requests := []struct{ Method, Path string }{{"GET", "/users"}, {"GET", "/users/5"}, {"GET", "/posts"}}
+	covered, uncovered := router.Coverage(requests)
+	if len(covered) != 2 || len(uncovered) != 1 || uncovered[0].HttpMethod != "POST" {
+		t.Errorf("expected the POST Route to be uncovered, got: %v %v", covered, uncovered)
+	}
+
+	// the reports don't count as hits
+	router.DumpMatches(ioutil.Discard, requests)
+	for name, hits := range router.HitCounts() {
+		if hits != 0 {
+			t.Errorf("%s: expected no hits, got: %d", name, hits)
+		}
+	}
+}
+
+func TestSplatResolution(t *testing.T) {
+
+	routes := []Route{
+		{HttpMethod: "GET", PathExp: "/a/*x"},
+		{HttpMethod: "GET", PathExp: "/a/b/*y"},
+		{HttpMethod: "GET", PathExp: "/:verylongname/*z"},
+	}
+	requests := []struct{ Method, Path string }{{"GET", "/a/b/c"}}
+
+	for resolution, expected := range map[SplatResolution]string{FirstDefinedSplat: "/a/*x", DeepestSplat: "/a/b/*y"} {
+		router := Router{SplatResolution: resolution}
+		if err := router.SetRoutes(routes...); err != nil {
+			t.Fatal(err)
+		}
+		route, _, _, err := router.FindRoute("GET", "/a/b/c")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if route == nil || route.PathExp != expected {
+			t.Errorf("%d: expected %s, got: %v", resolution, expected, route)
+		}
+		if results := router.Classify(requests); results[0].PathExp != expected {
+			t.Errorf("%d: expected Classify to pick %s, got: %s", resolution, expected, results[0].PathExp)
+		}
+	}
+
+	// the deepest splat, not the longest PathExp before the splat
+	router := Router{SplatResolution: DeepestSplat}
+	err := router.SetRoutes(
+		Route{HttpMethod: "GET", PathExp: "/:verylongname/*x"},
+		Route{HttpMethod: "GET", PathExp: "/a/b/*y"},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	route, _, _, _ := router.FindRoute("GET", "/a/b/c")
+	if route == nil || route.PathExp != "/a/b/*y" {
+		t.Errorf("expected /a/b/*y, got: %v", route)
+	}
+	if results := router.Classify(requests); results[0].PathExp != "/a/b/*y" {
+		t.Errorf("expected Classify to pick /a/b/*y, got: %s", results[0].PathExp)
+	}
+}
+
+func TestCollectMetrics(t *testing.T) {
+
+	router := Router{CountPerRoute: true}
+	err := router.SetRoutes(
+		Route{HttpMethod: "GET", PathExp: "/users"},
+		Route{HttpMethod: "GET", PathExp: "/users/:id"},
+		Route{HttpMethod: "DELETE", PathExp: "/users/:id"},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range []string{"/users", "/users/1", "/users/2", "/users/3", "/posts"} {
+		router.FindRoute("GET", path)
+	}
+
+	metrics := router.CollectMetrics()
+	if len(metrics) != 3 {
+		t.Fatalf("expected the metrics of the 3 Routes, got: %v", metrics)
+	}
+	for i, expected := range []int64{1, 3, 0} {
+		if metrics[i].Hits != expected {
+			t.Errorf("%s %s: expected %d hits, got: %d", metrics[i].Method, metrics[i].Pattern, expected, metrics[i].Hits)
+		}
+	}
+	if metrics[1].Method != "GET" || metrics[1].Pattern != "/users/:id" || metrics[1].LastMatched.IsZero() {
+		t.Errorf("expected the last match of GET /users/:id, got: %v", metrics[1])
+	}
+	if metrics[2].Method != "DELETE" || !metrics[2].LastMatched.IsZero() {
+		t.Errorf("expected a never hit DELETE Route, got: %v", metrics[2])
+	}
+}
+
+func TestSPAFallback(t *testing.T) {
+
+	router := Router{}
+	router.SPAFallback("index")
+	err := router.SetRoutes(
+		Route{HttpMethod: "GET", PathExp: "/api/users"},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for path, expected := range map[string]bool{"/dashboard/settings": true, "/app.js": false} {
+		urlObj := &url.URL{Path: path}
+		route, params, _ := router.FindRouteFromURL("GET", urlObj)
+		if (route != nil && route.Func == "index") != expected {
+			t.Errorf("%s: expected the index %v, got: %v", path, expected, route)
+		}
+		if expected && params["path"] != path[1:] {
+			t.Errorf("%s: expected the path in the params, got: %v", path, params)
+		}
+		if router.HasRoute("GET", urlObj) != expected {
+			t.Errorf("%s: expected HasRoute to be %v", path, expected)
+		}
+		if results := router.Classify([]struct{ Method, Path string }{{"GET", path}}); (results[0].PathExp == "/*path") != expected {
+			t.Errorf("%s: expected Classify to use the index %v, got: %v", path, expected, results[0])
+		}
+		if winner := router.FindContention("GET", urlObj).Winner; (winner != nil && winner.Route.Func == "index" && winner.Index == -1) != expected {
+			t.Errorf("%s: expected FindContention to use the index %v, got: %v", path, expected, winner)
+		}
+	}
+
+	// a path matched by a Route is not a miss
+	if router.HasRoute("POST", &url.URL{Path: "/api/users"}) {
+		t.Error("expected no fallback for a matched path")
+	}
+}
+
+func TestConcurrentBuild(t *testing.T) {
+
+	routes := []Route{
+		{HttpMethod: "GET", PathExp: "/users/:id"},
+		{HttpMethod: "GET", PathExp: "/users/me"},
+		{HttpMethod: "GET", PathExp: "/:section/me"},
+		{HttpMethod: "GET", PathExp: "/posts/*path"},
+		{HttpMethod: "GET", PathExp: "/posts/latest"},
+	}
+	serial := Router{}
+	if err := serial.SetRoutes(routes...); err != nil {
+		t.Fatal(err)
+	}
+	concurrent := Router{ConcurrentBuild: true}
+	if err := concurrent.SetRoutes(routes...); err != nil {
+		t.Fatal(err)
+	}
+
+	// the same Routes, in the same order
+	for _, path := range []string{"/users/me", "/users/5", "/blog/me", "/posts/latest", "/posts/a/b", "/nothing"} {
+		expected, _, _, _ := serial.FindRoute("GET", path)
+		route, _, _, _ := concurrent.FindRoute("GET", path)
+		if (route == nil) != (expected == nil) || route != nil && route.PathExp != expected.PathExp {
+			t.Errorf("%s: expected %v, got: %v", path, expected, route)
+		}
+	}
+
+	routes = append(routes, Route{HttpMethod: "GET", PathExp: "/users/:id"})
+	if err := concurrent.SetRoutes(routes...); err == nil {
+		t.Error("expected the duplicated Route to be rejected")
+	}
+}
+
+// the Routes of a large generated table
+func largeRouteTable() []Route {
+	routes := []Route{}
+	for i := 0; i < 50000; i++ {
+		routes = append(routes, Route{HttpMethod: "GET", PathExp: fmt.Sprintf("/%c%d/resources/:id", 'a'+i%26, i)})
+	}
+	return routes
+}
+
+func BenchmarkSetRoutes(b *testing.B) {
+	routes := largeRouteTable()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		router := Router{}
+		if err := router.SetRoutes(routes...); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkSetRoutesConcurrently(b *testing.B) {
+	routes := largeRouteTable()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		router := Router{ConcurrentBuild: true}
+		if err := router.SetRoutes(routes...); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestParamBackReference(t *testing.T) {
+
+	for _, order := range []SiblingOrder{DeclarationOrder, LiteralFirst} {
+		router := Router{SiblingOrder: order}
+		err := router.SetRoutes(
+			Route{HttpMethod: "GET", PathExp: "/repos/:owner/:name/compare/:owner2=owner"},
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		route, params, _, err := router.FindRoute("GET", "/repos/alice/lib/compare/alice")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if route == nil || params["owner"] != "alice" || params["owner2"] != "alice" || params["name"] != "lib" {
+			t.Errorf("%d: expected a match for the same owner, got: %v %v", order, route, params)
+		}
+		if !router.HasRoute("GET", &url.URL{Path: "/repos/alice/lib/compare/alice"}) {
+			t.Errorf("%d: expected HasRoute to match the same owner", order)
+		}
+
+		route, _, _, _ = router.FindRoute("GET", "/repos/alice/lib/compare/bob")
+		if route != nil {
+			t.Errorf("%d: expected no match for another owner, got: %v", order, route)
+		}
+		if router.HasRoute("GET", &url.URL{Path: "/repos/alice/lib/compare/bob"}) {
+			t.Errorf("%d: expected HasRoute to miss another owner", order)
+		}
+	}
+
+	router := Router{}
+	err := router.SetRoutes(Route{HttpMethod: "GET", PathExp: "/repos/:owner2=owner/:owner"})
+	if err == nil {
+		t.Error("expected a reference to a later param to be rejected")
+	}
+}
+
+func TestFindContention(t *testing.T) {
+
+	router := Router{}
+	err := router.SetRoutes(
+		Route{HttpMethod: "GET", PathExp: "/posts"},
+		Route{HttpMethod: "GET", PathExp: "/users/:id"},
+		Route{HttpMethod: "GET", PathExp: "/users/*path"},
+		Route{HttpMethod: "GET", PathExp: "/users/me"},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	contention := router.FindContention("GET", &url.URL{Path: "/users/me"})
+	if contention.Winner == nil || contention.Winner.Index != 1 || contention.Winner.Params["id"] != "me" {
+		t.Fatalf("expected /users/:id to win, got: %v", contention.Winner)
+	}
+	if len(contention.Losers) != 2 {
+		t.Fatalf("expected 2 losers, got: %v", contention.Losers)
+	}
+	if contention.Losers[0].Index != 2 || contention.Losers[0].Route.PathExp != "/users/*path" || contention.Losers[0].Params["path"] != "me" {
+		t.Errorf("expected /users/*path as the first loser, got: %v", contention.Losers[0])
+	}
+	if contention.Losers[1].Index != 3 || contention.Losers[1].Route.PathExp != "/users/me" {
+		t.Errorf("expected /users/me as the second loser, got: %v", contention.Losers[1])
+	}
+}
+
+func TestTrailingSlashNormalisation(t *testing.T) {
+
+	routes := []Route{
+		{HttpMethod: "GET", PathExp: "/x"},
+		{HttpMethod: "GET", PathExp: "/y/"},
+	}
+
+	router := Router{}
+	router.EnableTrailingSlashNormalisation(false)
+	if err := router.SetRoutes(routes...); err != nil {
+		t.Fatal(err)
+	}
+	for path, expected := range map[string]string{"/x/": "/x", "/y": "/y/", "/x": "/x"} {
+		route, _, _, err := router.FindRoute("GET", path)
+		if err != nil || route == nil || route.PathExp != expected {
+			t.Errorf("%s: expected %s, got: %v %v", path, expected, route, err)
+		}
+		if results := router.Classify([]struct{ Method, Path string }{{"GET", path}}); results[0].PathExp != expected || !results[0].PathMatched {
+			t.Errorf("%s: expected Classify to pick %s, got: %v", path, expected, results[0])
+		}
+	}
+
+	router = Router{}
+	router.EnableTrailingSlashNormalisation(true)
+	if err := router.SetRoutes(routes...); err != nil {
+		t.Fatal(err)
+	}
+	route, _, pathMatched := router.FindRouteFromURL("GET", &url.URL{Path: "/x/"})
+	if route != nil || pathMatched {
+		t.Errorf("expected a redirect not reported as a 405, got: %v %v", route, pathMatched)
+	}
+	_, _, _, err := router.FindRoute("GET", "/x/")
+	if redirect, ok := err.(*RedirectError); !ok || redirect.Path != "/x" {
+		t.Errorf("expected a redirect to /x, got: %v", err)
+	}
+	results := router.Classify([]struct{ Method, Path string }{{"GET", "/x/"}, {"GET", "/x"}})
+	if results[0].Redirect != "/x" || results[0].PathExp != "" || results[0].PathMatched {
+		t.Errorf("expected Classify to redirect to /x, got: %v", results[0])
+	}
+	if results[1].Redirect != "" || results[1].PathExp != "/x" {
+		t.Errorf("expected Classify to match /x, got: %v", results[1])
+	}
+
+	output := &strings.Builder{}
+	if err := router.DumpMatches(output, []struct{ Method, Path string }{{"GET", "/y"}}); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(output.String(), `"reason":"redirect","redirect":"/y/"`) {
+		t.Errorf("expected the redirect reason, got: %s", output)
+	}
+}
+
+func TestRouteAliasing(t *testing.T) {
+
+	router := Router{}
+	router.WithFormatSuffix("json")
+	err := router.SetRoutes(
+		Route{HttpMethod: "GET", PathExp: "/users/:id"},
+		Route{HttpMethod: "DELETE", PathExp: "/users/:id"},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := router.EnableRouteAliasing("/api/v1/users/:id", "/users/:id"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, method := range []string{"GET", "DELETE"} {
+		route, params, _, err := router.FindRoute(method, "/api/v1/users/5")
+		if err != nil || route == nil || route.PathExp != "/users/:id" || params["id"] != "5" {
+			t.Errorf("%s: expected the canonical Route, got: %v %v %v", method, route, params, err)
+		}
+	}
+
+	route, params, _, _ := router.FindRoute("GET", "/api/v1/users/5.json")
+	if route == nil || route.PathExp != "/users/:id" || params["id"] != "5" || params["format"] != "json" {
+		t.Errorf("expected the alias to take the format, got: %v %v", route, params)
+	}
+
+	if err := router.EnableRouteAliasing("/api/v1/posts/:slug", "/posts/:id"); err == nil {
+		t.Error("expected an alias with other placeholders to be rejected")
+	}
+}
+
+func TestPathRewriting(t *testing.T) {
+
+	router := Router{}
+	if err := router.EnablePathRewriting("/old/:id", "/new/items/:id"); err != nil {
+		t.Fatal(err)
+	}
+	if err := router.EnablePathRewriting("/a", "/b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := router.EnablePathRewriting("/b", "/a"); err != nil {
+		t.Fatal(err)
+	}
+	err := router.SetRoutes(
+		Route{HttpMethod: "GET", PathExp: "/new/items/:id"},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	route, params, _, err := router.FindRoute("GET", "/old/3")
+	if err != nil || route == nil || params["id"] != "3" || params["_original_path"] != "/old/3" {
+		t.Errorf("expected the rewritten path to match, got: %v %v %v", route, params, err)
+	}
+	_, params, _, _ = router.FindRoute("GET", "/new/items/3")
+	if _, ok := params["_original_path"]; ok {
+		t.Errorf("expected no original path when not rewritten, got: %v", params)
+	}
+
+	results := router.Classify([]struct{ Method, Path string }{{"GET", "/old/3"}})
+	if results[0].PathExp != "/new/items/:id" {
+		t.Errorf("expected Classify to rewrite the path, got: %v", results[0])
+	}
+
+	if _, _, _, err := router.FindRoute("GET", "/a"); err != ErrRewriteLoop {
+		t.Errorf("expected a rewrite loop, got: %v", err)
+	}
+	output := &strings.Builder{}
+	if err := router.DumpMatches(output, []struct{ Method, Path string }{{"GET", "/a"}}); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(output.String(), `"reason":"rewrite_loop"`) {
+		t.Errorf("expected the rewrite_loop reason, got: %s", output)
+	}
+}
+
+func TestTopLevelSegments(t *testing.T) {
+
+	router := Router{}
+	router.EnablePathHashing(func(pathExp string) string {
+		return "s" + fmt.Sprint(len(pathExp))
+	})
+	err := router.SetRoutes(
+		Route{HttpMethod: "GET", PathExp: "/"},
+		Route{HttpMethod: "GET", PathExp: "/users/:id", ShortPath: true},
+		Route{HttpMethod: "GET", PathExp: "/:lang/home"},
+		Route{HttpMethod: "GET", PathExp: "/v:version/status"},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := router.EnableRouteAliasing("/api/v1/users/:id", "/users/:id"); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"", ":", "api", "s10", "users", "v"}
+	if segments := router.TopLevelSegments(); fmt.Sprint(segments) != fmt.Sprint(expected) {
+		t.Errorf("expected %v, got: %v", expected, segments)
+	}
+	if route, _, _, _ := router.FindRoute("GET", "/s10/5"); route == nil || route.PathExp != "/users/:id" {
+		t.Errorf("expected the short path to match, got: %v", route)
+	}
+}
+
+func TestCacheMetadata(t *testing.T) {
+
+	router := Router{}
+	err := router.SetRoutes(
+		Route{
+			HttpMethod:   "GET",
+			PathExp:      "/users/:id",
+			CacheControl: "max-age=60",
+			ETagFunc: func(r *http.Request) string {
+				return `"` + r.URL.Path + `"`
+			},
+		},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest("GET", "/users/5", nil)
+	route, _, _ := router.FindRouteFromRequest(r)
+	if route == nil || route.CacheControl != "max-age=60" {
+		t.Fatalf("expected the cache metadata of the Route, got: %v", route)
+	}
+	if route.ETagFunc == nil || route.ETagFunc(r) != `"/users/5"` {
+		t.Error("expected the ETagFunc of the Route")
+	}
+}
+
+func TestRequestTranslation(t *testing.T) {
+
+	router := Router{}
+	router.EnableRequestTranslation(func(method, path string) (string, string) {
+		if method == "GET" && path == "/v1/users/me" {
+			return "GET", "/api/internal/users/self"
+		}
+		return method, path
+	})
+	err := router.SetRoutes(
+		Route{HttpMethod: "GET", PathExp: "/api/internal/users/:id"},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	urlObj := &url.URL{Path: "/v1/users/me"}
+	route, params, _ := router.FindRouteFromURL("GET", urlObj)
+	if route == nil || params["id"] != "self" {
+		t.Errorf("expected the translated path to match, got: %v %v", route, params)
+	}
+	if urlObj.Path != "/v1/users/me" {
+		t.Errorf("expected the URL to be left untouched, got: %s", urlObj.Path)
+	}
+	if !router.HasRoute("GET", urlObj) {
+		t.Error("expected HasRoute to translate the path")
+	}
+	if route, _, _ := router.FindRouteFromURL("GET", &url.URL{Path: "/v1/users/other"}); route != nil {
+		t.Errorf("expected the untranslated path to miss, got: %v", route)
+	}
+}
+
+func TestExcludeMethods(t *testing.T) {
+
+	router := Router{}
+	err := router.SetRoutes(
+		Route{HttpMethod: AnyMethod, PathExp: "/proxy/*path", ExcludeMethods: []string{"TRACE"}},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	urlObj := &url.URL{Path: "/proxy/a/b"}
+	route, params, _ := router.FindRouteFromURL("GET", urlObj)
+	if route == nil || params["path"] != "a/b" {
+		t.Errorf("expected GET to match, got: %v %v", route, params)
+	}
+	if !router.HasRoute("GET", urlObj) {
+		t.Error("expected HasRoute to match GET")
+	}
+
+	route, _, pathMatched := router.FindRouteFromURL("trace", urlObj)
+	if route != nil || !pathMatched {
+		t.Errorf("expected a 405 for TRACE, got: %v %v", route, pathMatched)
+	}
+	if router.HasRoute("TRACE", urlObj) {
+		t.Error("expected HasRoute to exclude TRACE")
+	}
+}
+
+func TestFindRouteComplete(t *testing.T) {
+
+	router := Router{}
+	router.WithFormatSuffix("json")
+	err := router.SetRoutes(
+		Route{HttpMethod: "GET", PathExp: "/users/:id"},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	route, params, _ := router.FindRouteComplete("GET", &url.URL{Path: "/users/5"})
+	if route == nil || params["id"] != "5" {
+		t.Fatalf("expected a match, got: %v %v", route, params)
+	}
+	if format, ok := params["format"]; !ok || format != "" {
+		t.Errorf("expected an empty format, got: %v", params)
+	}
+
+	// the sparse default
+	_, params, _ = router.FindRouteFromURL("GET", &url.URL{Path: "/users/5"})
+	if _, ok := params["format"]; ok {
+		t.Errorf("expected no format with FindRouteFromURL, got: %v", params)
+	}
+}
+
+func TestTimeoutByRoute(t *testing.T) {
+
+	router := Router{}
+	router.EnableTimeoutByRoute(map[string]time.Duration{
+		"GET:/users/:id":  2 * time.Second,
+		"POST:/users/:id": 3 * time.Second,
+	})
+	err := router.SetRoutes(
+		Route{HttpMethod: "get", PathExp: "/users/:id"},
+		Route{HttpMethod: "POST", PathExp: "/users/:id", Timeout: time.Second},
+		Route{HttpMethod: "DELETE", PathExp: "/users/:id"},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	routes := router.Routes()
+	for i, expected := range []time.Duration{2 * time.Second, time.Second, 0} {
+		if routes[i].Timeout != expected {
+			t.Errorf("%s %s: expected %v, got: %v", routes[i].HttpMethod, routes[i].PathExp, expected, routes[i].Timeout)
+		}
+	}
+	route, _, _, _ := router.FindRoute("GET", "/users/5")
+	if route == nil || route.Timeout != 2*time.Second {
+		t.Errorf("expected the matched Route to carry its Timeout, got: %v", route)
+	}
+}
+
+func TestPreMatch(t *testing.T) {
+
+	maintenance := true
+	router := Router{
+		PreMatch: func(method, path string) bool {
+			return !maintenance || path == "/health"
+		},
+	}
+	err := router.SetRoutes(
+		Route{HttpMethod: "GET", PathExp: "/users/:id"},
+		Route{HttpMethod: "GET", PathExp: "/health"},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	requests := []struct{ Method, Path string }{{"GET", "/users/5"}, {"GET", "/health"}}
+
+	route, _, pathMatched, err := router.FindRoute("GET", "/users/5")
+	if err != ErrRejected || route != nil || pathMatched {
+		t.Errorf("expected the lookup to be rejected, got: %v %v %v", route, pathMatched, err)
+	}
+	if match := router.FindRouteDetailed("GET", &url.URL{Path: "/users/5"}); !match.Rejected || match.Route != nil {
+		t.Errorf("expected a rejected detailed lookup, got: %v", match)
+	}
+	if router.HasRoute("GET", &url.URL{Path: "/users/5"}) {
+		t.Error("expected HasRoute to be rejected")
+	}
+	if results := router.Classify(requests); results[0].PathExp != "" || results[1].PathExp != "/health" {
+		t.Errorf("expected Classify to reject the first request only, got: %v", results)
+	}
+
+	maintenance = false
+	route, params, _, err := router.FindRoute("GET", "/users/5")
+	if err != nil || route == nil || params["id"] != "5" {
+		t.Errorf("expected the lookup to proceed, got: %v %v %v", route, params, err)
+	}
+	if match := router.FindRouteDetailed("GET", &url.URL{Path: "/users/5"}); match.Rejected || match.Route == nil {
+		t.Errorf("expected a detailed match, got: %v", match)
+	}
+	if !router.HasRoute("GET", &url.URL{Path: "/users/5"}) {
+		t.Error("expected HasRoute to proceed")
+	}
+	if results := router.Classify(requests); results[0].PathExp != "/users/:id" {
+		t.Errorf("expected Classify to proceed, got: %v", results)
+	}
+}
+
+func TestBacktrackingRoutes(t *testing.T) {
+
+	routes := []Route{
+		{HttpMethod: "GET", PathExp: "/files/*path"},
+		{HttpMethod: "GET", PathExp: "/files/readme"},
+		{HttpMethod: "GET", PathExp: "/users"},
+	}
+	for order, expected := range map[SiblingOrder]string{DeclarationOrder: "/files/readme", LiteralFirst: "/files/*path"} {
+		router := Router{SiblingOrder: order}
+		if err := router.SetRoutes(routes...); err != nil {
+			t.Fatal(err)
+		}
+		flagged := router.BacktrackingRoutes()
+		if len(flagged) != 1 || flagged[0].PathExp != expected {
+			t.Errorf("%d: expected %s to be flagged, got: %v", order, expected, flagged)
+		}
+	}
+
+	// no Routes, or only mounted hosts
+	router := Router{}
+	if flagged := router.BacktrackingRoutes(); len(flagged) != 0 {
+		t.Errorf("expected no Routes, got: %v", flagged)
+	}
+	if err := router.MountHost("a.example.com", &Router{}); err != nil {
+		t.Fatal(err)
+	}
+	if flagged := router.BacktrackingRoutes(); len(flagged) != 0 {
+		t.Errorf("expected no Routes, got: %v", flagged)
+	}
+}
+
+func TestSiblingOrder(t *testing.T) {
+
+	routes := []Route{
+		{HttpMethod: "GET", PathExp: "/users/:id"},
+		{HttpMethod: "GET", PathExp: "/users/me"},
+	}
+	for order, expected := range map[SiblingOrder]string{DeclarationOrder: "/users/:id", LiteralFirst: "/users/me"} {
+		router := Router{SiblingOrder: order}
+		if err := router.SetRoutes(routes...); err != nil {
+			t.Fatal(err)
+		}
+		route, _, _, err := router.FindRoute("GET", "/users/me")
+		if err != nil || route == nil || route.PathExp != expected {
+			t.Errorf("%d: expected %s to win, got: %v %v", order, expected, route, err)
+		}
+		if results := router.Classify([]struct{ Method, Path string }{{"GET", "/users/me"}}); results[0].PathExp != expected {
+			t.Errorf("%d: expected Classify to pick %s, got: %v", order, expected, results[0])
+		}
+		if route, _, _, _ := router.FindRoute("GET", "/users/5"); route == nil || route.PathExp != "/users/:id" {
+			t.Errorf("%d: expected /users/:id for another id, got: %v", order, route)
+		}
+	}
+}
+
+func TestDumpMatches(t *testing.T) {
+
+	router := Router{}
+	err := router.SetRoutes(
+		Route{HttpMethod: "GET", PathExp: "/users/:id/posts/:post"},
+		Route{HttpMethod: "POST", PathExp: "/users"},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	requests := []struct{ Method, Path string }{
+		{"GET", "/users/5/posts/7"},
+		{"GET", "/users"},
+		{"GET", "/posts"},
+		{"GET", "/%zz"},
+	}
+
+	golden := `{"method":"GET","path":"/users/5/posts/7","pattern":"/users/:id/posts/:post","params":{"id":"5","post":"7"},"reason":"matched"}
+{"method":"GET","path":"/users","pattern":"","params":null,"reason":"method_not_allowed"}
+{"method":"GET","path":"/posts","pattern":"","params":null,"reason":"not_found"}
+{"method":"GET","path":"/%zz","pattern":"","params":null,"reason":"invalid_url"}
+`
+	for i := 0; i < 2; i++ {
+		output := &strings.Builder{}
+		if err := router.DumpMatches(output, requests); err != nil {
+			t.Fatal(err)
+		}
+		if output.String() != golden {
+			t.Errorf("expected:\n%s\ngot:\n%s", golden, output)
+		}
+	}
+}
+
+func TestCaptureTrailingSlash(t *testing.T) {
+
+	router := Router{CaptureTrailingSlash: true}
+	err := router.SetRoutes(
+		Route{HttpMethod: "GET", PathExp: "/x"},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for path, expected := range map[string]string{"/x": "false", "/x/": "true"} {
+		route, params, _, err := router.FindRoute("GET", path)
+		if err != nil || route == nil || route.PathExp != "/x" {
+			t.Errorf("%s: expected /x, got: %v %v", path, route, err)
+		}
+		if params["_slash"] != expected {
+			t.Errorf("%s: expected _slash to be %s, got: %v", path, expected, params)
+		}
+	}
+}
+
+func TestFindValidRoute(t *testing.T) {
+
+	router := Router{}
+	err := router.SetRoutes(
+		Route{
+			HttpMethod: "GET",
+			PathExp:    "/users/:id",
+			Validate: func(params map[string]string) error {
+				if _, err := strconv.Atoi(params["id"]); err != nil {
+					return errors.New("id must be numeric")
+				}
+				return nil
+			},
+		},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	route, params, _, err := router.FindValidRoute("GET", &url.URL{Path: "/users/abc"})
+	validationErr, ok := err.(*ValidationError)
+	if !ok || validationErr.Route != route || route == nil || params["id"] != "abc" {
+		t.Errorf("expected a validation error for a non numeric id, got: %v %v %v", route, params, err)
+	}
+
+	route, params, _, err = router.FindValidRoute("GET", &url.URL{Path: "/users/5"})
+	if err != nil || route == nil || params["id"] != "5" {
+		t.Errorf("expected a valid id to proceed, got: %v %v %v", route, params, err)
+	}
+
+	route, _, pathMatched, err := router.FindValidRoute("POST", &url.URL{Path: "/users/5"})
+	if err != nil || route != nil || !pathMatched {
+		t.Errorf("expected a 405 without validation, got: %v %v %v", route, pathMatched, err)
+	}
+}
+
+func TestMeshRules(t *testing.T) {
+
+	router := Router{}
+	err := router.SetRoutes(
+		Route{HttpMethod: "GET", PathExp: "/users/:id"},
+		Route{HttpMethod: AnyMethod, PathExp: "/proxy/*path", ExcludeMethods: []string{"TRACE"}},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := router.EnableRouteAliasing("/api/v1/users/:id", "/users/:id"); err != nil {
+		t.Fatal(err)
+	}
+
+	rules := router.MeshRules()
+	if len(rules) != 3 {
+		t.Fatalf("expected the rules of the Routes and the alias, got: %v", rules)
+	}
+	if rules[0].Method != "GET" || rules[0].PathPrefix != "/users/" {
+		t.Errorf("expected the /users/ prefix, got: %v", rules[0])
+	}
+	regex := regexp.MustCompile(rules[0].PathRegex)
+	if !regex.MatchString("/users/5") || regex.MatchString("/users/5/posts") || regex.MatchString("/users/") {
+		t.Errorf("expected the regex to match the id segment only, got: %s", rules[0].PathRegex)
+	}
+	if rules[1].PathPrefix != "/api/v1/users/" || !regexp.MustCompile(rules[1].PathRegex).MatchString("/api/v1/users/5") {
+		t.Errorf("expected the rule of the alias, got: %v", rules[1])
+	}
+	if rules[2].Method != "" || len(rules[2].ExcludeMethods) != 1 || rules[2].ExcludeMethods[0] != "TRACE" {
+		t.Errorf("expected an ANY rule excluding TRACE, got: %v", rules[2])
+	}
+}
+
+func TestSplatWarnings(t *testing.T) {
+
+	router := Router{SplatWarningDepth: 2}
+	err := router.SetRoutes(
+		Route{HttpMethod: "GET", PathExp: "/*all"},
+		Route{HttpMethod: "GET", PathExp: "/:p/*z"},
+		Route{HttpMethod: "GET", PathExp: "/static/:version/*file"},
+		Route{HttpMethod: "GET", PathExp: "/static/assets/img/*file"},
+		Route{HttpMethod: "GET", PathExp: "/users/:id"},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	warnings := router.Warnings()
+	if len(warnings) != 3 {
+		t.Fatalf("expected 3 warnings, got: %v", warnings)
+	}
+	for i, pathExp := range []string{"/*all", "/:p/*z", "/static/:version/*file"} {
+		if !strings.Contains(warnings[i], pathExp+":") {
+			t.Errorf("expected a warning for %s, got: %s", pathExp, warnings[i])
+		}
+	}
+}
+
+func TestMultiRouter(t *testing.T) {
+
+	a := &Router{}
+	a.EnableTrailingSlashNormalisation(true)
+	if err := a.SetRoutes(Route{HttpMethod: "GET", PathExp: "/x"}); err != nil {
+		t.Fatal(err)
+	}
+	b := &Router{}
+	if err := b.SetRoutes(Route{HttpMethod: "GET", PathExp: "/plugins/b/:id"}, Route{HttpMethod: "GET", PathExp: "/*all"}); err != nil {
+		t.Fatal(err)
+	}
+	multi := MultiRouter{}
+	if err := multi.Add("A", a); err != nil {
+		t.Fatal(err)
+	}
+	if err := multi.Add("B", b); err != nil {
+		t.Fatal(err)
+	}
+	if err := multi.Add("A", b); err == nil {
+		t.Error("expected a name to be used only once")
+	}
+
+	name, route, params, _, err := multi.FindRoute("GET", "/plugins/b/5")
+	if err != nil || name != "B" || route == nil || route.PathExp != "/plugins/b/:id" || params["id"] != "5" {
+		t.Errorf("expected the Route of B, got: %s %v %v %v", name, route, params, err)
+	}
+
+	// the redirect of A is not given to the catch-all of B
+	name, route, _, _, err = multi.FindRoute("GET", "/x/")
+	if redirect, ok := err.(*RedirectError); !ok || redirect.Path != "/x" || name != "A" || route != nil {
+		t.Errorf("expected A to redirect, got: %s %v %v", name, route, err)
+	}
+	if name, route, _, _ := multi.FindRouteFromURL("GET", &url.URL{Path: "/x/"}); name != "A" || route != nil {
+		t.Errorf("expected A to own the redirect, got: %s %v", name, route)
+	}
+}
+
+func TestDynamicWeights(t *testing.T) {
+
+	router := Router{}
+	router.EnableDynamicWeights(func(route *Route) int {
+		// the literal Routes first
+		if strings.ContainsAny(route.PathExp, ":*") {
+			return 0
+		}
+		return 1
+	})
+	err := router.SetRoutes(
+		Route{HttpMethod: "GET", PathExp: "/users/:id"},
+		Route{HttpMethod: "GET", PathExp: "/*all"},
+		Route{HttpMethod: "GET", PathExp: "/users/me"},
+		Route{HttpMethod: "GET", PathExp: "/users"},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	order := []string{}
+	for _, route := range router.Routes() {
+		order = append(order, route.PathExp)
+	}
+	expected := []string{"/users/me", "/users", "/users/:id", "/*all"}
+	if fmt.Sprint(order) != fmt.Sprint(expected) {
+		t.Errorf("expected the order %v, got: %v", expected, order)
+	}
+
+	if route, _, _, _ := router.FindRoute("GET", "/users/me"); route == nil || route.PathExp != "/users/me" {
+		t.Errorf("expected the heavier Route to win, got: %v", route)
+	}
+	if route, _, _, _ := router.FindRoute("GET", "/users/5"); route == nil || route.PathExp != "/users/:id" {
+		t.Errorf("expected the earlier Route of the same weight to win, got: %v", route)
+	}
+}
+
+func TestSPAFallbackParams(t *testing.T) {
+
+	router := Router{CaptureScheme: true, CaptureTrailingSlash: true}
+	router.SPAFallback("index")
+	err := router.SetRoutes(
+		Route{HttpMethod: "GET", PathExp: "/api/users"},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	route, params, _, err := router.FindRoute("GET", "https://x.com/dash/")
+	if err != nil || route == nil || route.Func != "index" {
+		t.Fatalf("expected the index, got: %v %v", route, err)
+	}
+	if params["path"] != "dash" || params["_scheme"] != "https" || params["_slash"] != "true" {
+		t.Errorf("expected the params of a Route, got: %v", params)
+	}
+}
+
+func TestRouteSummary(t *testing.T) {
+
+	for _, lazy := range []bool{false, true} {
+		router := Router{}
+		if lazy {
+			router.EnableRouteCompression()
+		}
+		err := router.SetRoutes(
+			Route{HttpMethod: "GET", PathExp: "/users/:id", Summary: "Get a user"},
+			Route{HttpMethod: "DELETE", PathExp: "/users/:id", Summary: "Delete a user"},
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		route, _, _, _ := router.FindRoute("DELETE", "/users/5")
+		if route == nil || route.Summary != "Delete a user" {
+			t.Errorf("expected the Summary of the matched Route, got: %v", route)
+		}
+		routes := router.Routes()
+		if len(routes) != 2 || routes[0].Summary != "Get a user" || routes[1].Summary != "Delete a user" {
+			t.Errorf("expected the Summaries in Routes, got: %v", routes)
+		}
+	}
+}
+
+func TestRouteAliasingKeepsRoutes(t *testing.T) {
+
+	router := Router{CountPerRoute: true}
+	err := router.SetRoutes(
+		Route{HttpMethod: "GET", PathExp: "/users/:id"},
+		Route{HttpMethod: "GET", PathExp: "/members/:id"},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	router.FindRoute("GET", "/users/1")
+	router.FindRoute("GET", "/users/2")
+
+	if err := router.EnableRouteAliasing("/api/users/:id", "/users/:id"); err != nil {
+		t.Fatal(err)
+	}
+	if hits := router.HitCounts()["GET /users/:id"]; hits != 2 {
+		t.Errorf("expected the hit counts to be kept, got: %d", hits)
+	}
+
+	// an alias conflicting with a Route is rejected, the previous lookups are kept
+	if err := router.EnableRouteAliasing("/members/:id", "/users/:id"); err == nil {
+		t.Fatal("expected the conflicting alias to be rejected")
+	}
+	for path, expected := range map[string]string{"/api/users/3": "/users/:id", "/members/3": "/members/:id"} {
+		if route, _, _, _ := router.FindRoute("GET", path); route == nil || route.PathExp != expected {
+			t.Errorf("%s: expected %s, got: %v", path, expected, route)
+		}
+	}
+	if hits := router.HitCounts()["GET /users/:id"]; hits != 3 {
+		t.Errorf("expected the hit counts to be kept after the error, got: %d", hits)
+	}
+}
+
+func TestPathRewritingWithRedirect(t *testing.T) {
+
+	router := Router{}
+	router.EnableTrailingSlashNormalisation(true)
+	if err := router.EnablePathRewriting("/old/:id", "/new/:id/"); err != nil {
+		t.Fatal(err)
+	}
+	err := router.SetRoutes(
+		Route{HttpMethod: "GET", PathExp: "/new/:id"},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// no redirect to the original path, that no Route matches
+	route, params, _, err := router.FindRoute("GET", "/old/3")
+	if err != nil || route == nil || params["id"] != "3" {
+		t.Errorf("expected the rewritten path to match without redirect, got: %v %v %v", route, params, err)
+	}
+	if !router.HasRoute("GET", &url.URL{Path: "/old/3"}) {
+		t.Error("expected HasRoute to match the rewritten path")
+	}
+	if results := router.Classify([]struct{ Method, Path string }{{"GET", "/old/3"}}); results[0].PathExp != "/new/:id" || results[0].Redirect != "" {
+		t.Errorf("expected Classify to match the rewritten path, got: %v", results[0])
+	}
+
+	// the paths not rewritten are still redirected
+	if _, _, _, err := router.FindRoute("GET", "/new/3/"); !isRedirect(err) {
+		t.Errorf("expected a redirect, got: %v", err)
+	}
+}
+
+func TestRouteTimeoutPrecedence(t *testing.T) {
+
+	router := Router{}
+	router.EnableTimeoutByRoute(map[string]time.Duration{
+		"GET:/a": 2 * time.Second,
+		"GET:/b": 2 * time.Second,
+	})
+	router.EnableRouteTimeout(3 * time.Second)
+	err := router.SetRoutes(
+		Route{HttpMethod: "GET", PathExp: "/a", Timeout: time.Second},
+		Route{HttpMethod: "GET", PathExp: "/b"},
+		Route{HttpMethod: "GET", PathExp: "/c"},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the explicit Timeout, then the map, then the default
+	routes := router.Routes()
+	for i, expected := range []time.Duration{time.Second, 2 * time.Second, 3 * time.Second} {
+		if routes[i].Timeout != expected {
+			t.Errorf("%s: expected %v, got: %v", routes[i].PathExp, expected, routes[i].Timeout)
+		}
+	}
+}
+
+func TestMethodRouting(t *testing.T) {
+
+	router := Router{}
+	router.EnableMethodRouting(func(r *http.Request) string {
+		return r.URL.Query().Get("_method")
+	})
+	err := router.SetRoutes(
+		Route{HttpMethod: "GET", PathExp: "/users/:id"},
+		Route{HttpMethod: "POST", PathExp: "/users/:id"},
+		Route{HttpMethod: "DELETE", PathExp: "/users/:id"},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a GET is never overridden
+	route, _, _ := router.FindRouteFromRequest(httptest.NewRequest("GET", "/users/5?_method=DELETE", nil))
+	if route == nil || route.HttpMethod != "GET" {
+		t.Errorf("expected the GET to stay a GET, got: %v", route)
+	}
+
+	route, _, _ = router.FindRouteFromRequest(httptest.NewRequest("POST", "/users/5?_method=DELETE", nil))
+	if route == nil || route.HttpMethod != "DELETE" {
+		t.Errorf("expected the POST to become a DELETE, got: %v", route)
+	}
+
+	route, _, _ = router.FindRouteFromRequest(httptest.NewRequest("POST", "/users/5", nil))
+	if route == nil || route.HttpMethod != "POST" {
+		t.Errorf("expected the POST to stay a POST without override, got: %v", route)
+	}
+}
+
+func TestRouteCompression(t *testing.T) {
+
+	routes := []Route{
+		{HttpMethod: "GET", PathExp: "/users/:id"},
+		{HttpMethod: "GET", PathExp: "/users/:id/posts"},
+		{HttpMethod: "GET", PathExp: "/userinfo"},
+		{HttpMethod: "GET", PathExp: "/static/*file"},
+	}
+	paths := []string{"/users/5", "/users/5/posts", "/userinfo", "/static/a/b", "/user", "/nothing"}
+	requests := []struct{ Method, Path string }{}
+	for _, path := range paths {
+		requests = append(requests, struct{ Method, Path string }{"GET", path})
+	}
+
+	eager := Router{}
+	if err := eager.SetRoutes(routes...); err != nil {
+		t.Fatal(err)
+	}
+	lazy := Router{}
+	lazy.EnableRouteCompression()
+	if err := lazy.SetRoutes(routes...); err != nil {
+		t.Fatal(err)
+	}
+
+	// the first lookups at the same time, run with -race
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(3)
+		go func() {
+			defer wg.Done()
+			lazy.FindRoute("GET", "/users/5")
+		}()
+		go func() {
+			defer wg.Done()
+			lazy.HasRoute("GET", &url.URL{Path: "/userinfo"})
+		}()
+		go func() {
+			defer wg.Done()
+			lazy.Classify(requests)
+		}()
+	}
+	wg.Wait()
+
+	// the same lookups as the eager compression
+	expected := eager.Classify(requests)
+	results := lazy.Classify(requests)
+	for i, path := range paths {
+		if results[i] != expected[i] {
+			t.Errorf("%s: expected %v, got: %v", path, expected[i], results[i])
+		}
+		want, wantParams, _, _ := eager.FindRoute("GET", path)
+		got, gotParams, _, _ := lazy.FindRoute("GET", path)
+		if fmt.Sprint(got, gotParams) != fmt.Sprint(want, wantParams) {
+			t.Errorf("%s: expected %v %v, got: %v %v", path, want, wantParams, got, gotParams)
+		}
+	}
+}
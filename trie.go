@@ -1,7 +1,10 @@
 // Special Trie implementation for HTTP routing.
 //
 // This Trie implementation is designed to support strings that includes
-// :param and *splat parameters. Strings that are commonly used to represent
+// :param and *splat parameters. A :param can declare aliases, like :userID|id,
+// to capture its value under several names, a type, like :id:int, to only
+// match the values of that type, and a back-reference, like :owner2=owner, to
+// only match the value of an earlier param. Strings that are commonly used to represent
 // the Path in HTTP routing. This implementation also maintain for each Path
 // a map of HTTP Methods associated with the Route.
 //
@@ -12,6 +15,10 @@ package route
 import (
 	"errors"
 	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
 )
 
 func splitParam(remaining string) (string, string) {
@@ -22,12 +29,53 @@ func splitParam(remaining string) (string, string) {
 	return remaining[:i], remaining[i:]
 }
 
+// Routes inserted with this http method match any http method.
+const AnyMethod = "ANY"
+
+// split a :param declaration like "userID|id:int=ref" in its names, its type and its back-reference,
+// only the ":int" suffix is a type, other ':' are part of the name like in ":hh:mm"
+func parsePlaceholder(decl string) ([]string, string, string) {
+	kind, ref := "", ""
+	if i := strings.IndexByte(decl, '='); i != -1 {
+		decl, ref = decl[:i], decl[i+1:]
+	}
+	if strings.HasSuffix(decl, ":int") {
+		decl, kind = decl[:len(decl)-len(":int")], "int"
+	}
+	return strings.Split(decl, "|"), kind, ref
+}
+
+// return the placeholder names declared in the path expression, aliases included
+func placeholderNames(pathExp string) []string {
+	names := []string{}
+	for i := 0; i < len(pathExp); i++ {
+		switch pathExp[i] {
+		case ':':
+			decl, remaining := splitParam(pathExp[i+1:])
+			declNames, _, _ := parsePlaceholder(decl)
+			names = append(names, declNames...)
+			i = len(pathExp) - len(remaining) - 1
+		case '*':
+			return append(names, pathExp[i+1:])
+		}
+	}
+	return names
+}
+
 type node struct {
 	HttpMethodToRoute map[string]interface{}
 	Children          map[string]*node
 	ChildrenKeyLen    int
 	ParamChild        *node
 	ParamName         string
+	ParamNames        []string
+	IntParamChild     *node
+	IntParamName      string
+	IntParamNames     []string
+	RefParamChild     *node
+	RefParamName      string
+	RefParamNames     []string
+	RefParamRef       string
 	SplatChild        *node
 	SplatName         string
 }
@@ -59,31 +107,68 @@ func (self *node) addRoute(httpMethod, pathExp string, route interface{}, usedPa
 		var name string
 		name, remaining = splitParam(remaining)
 
-		// Check param name is unique
-		for _, e := range usedParams {
-			if e == name {
+		// Check the back-reference is to an earlier param
+		names, kind, ref := parsePlaceholder(name)
+		if ref != "" {
+			found := false
+			for _, e := range usedParams {
+				found = found || e == ref
+			}
+			if !found {
 				return errors.New(
-					fmt.Sprintf("A route can't have two params with the same name: %s", name),
+					fmt.Sprintf("A param can only reference an earlier param: %s", ref),
 				)
 			}
 		}
-		usedParams = append(usedParams, name)
 
-		if self.ParamChild == nil {
-			self.ParamChild = &node{}
-			self.ParamName = name
+		// Check param name and aliases are unique
+		for _, alias := range names {
+			for _, e := range usedParams {
+				if e == alias {
+					return errors.New(
+						fmt.Sprintf("A route can't have two params with the same name: %s", alias),
+					)
+				}
+			}
+			usedParams = append(usedParams, alias)
+		}
+
+		// the typed params and the back-references have their own branch
+		child, childName, childNames := &self.ParamChild, &self.ParamName, &self.ParamNames
+		switch kind {
+		case "":
+			if ref != "" {
+				child, childName, childNames = &self.RefParamChild, &self.RefParamName, &self.RefParamNames
+			}
+		case "int":
+			if ref != "" {
+				return errors.New(
+					fmt.Sprintf("A typed param can't reference another param: %s", name),
+				)
+			}
+			child, childName, childNames = &self.IntParamChild, &self.IntParamName, &self.IntParamNames
+			name = name[:len(name)-len(":int")]
+		}
+
+		if *child == nil {
+			*child = &node{}
+			*childName = name
+			*childNames = names
+			if ref != "" {
+				self.RefParamRef = ref
+			}
 		} else {
-			if self.ParamName != name {
+			if *childName != name {
 				return errors.New(
 					fmt.Sprintf(
 						"Routes sharing a common placeholder MUST name it consistently: %s != %s",
-						self.ParamName,
+						*childName,
 						name,
 					),
 				)
 			}
 		}
-		nextNode = self.ParamChild
+		nextNode = *child
 	} else if token[0] == '*' {
 		// *splat case
 		name := remaining
@@ -95,6 +180,18 @@ func (self *node) addRoute(httpMethod, pathExp string, route interface{}, usedPa
 		nextNode = self.SplatChild
 	} else {
 		// general case
+		if self.ChildrenKeyLen > 1 {
+			// compressed node, follow the edge if it exists, otherwise split
+			// the edges of this node only and compress them back once inserted
+			length := self.ChildrenKeyLen
+			if len(pathExp) >= length && !strings.ContainsAny(pathExp[:length], ":*") {
+				if edgeNode := self.Children[pathExp[:length]]; edgeNode != nil {
+					return edgeNode.addRoute(httpMethod, pathExp[length:], route, usedParams)
+				}
+			}
+			self.decompress()
+			defer self.compress()
+		}
 		if self.Children == nil {
 			self.Children = map[string]*node{}
 			self.ChildrenKeyLen = 1
@@ -108,25 +205,62 @@ func (self *node) addRoute(httpMethod, pathExp string, route interface{}, usedPa
 	return nextNode.addRoute(httpMethod, remaining, route, usedParams)
 }
 
+// a placeholder name and its value for a given path
+type param struct {
+	name     string
+	value    string
+	isInt    bool
+	intValue int
+}
+
+// return the route of this node for the http method, and the route for AnyMethod
+func (self *node) methodRoutes(httpMethod string) [2]interface{} {
+	if httpMethod == AnyMethod {
+		return [2]interface{}{self.HttpMethodToRoute[httpMethod], nil}
+	}
+	return [2]interface{}{self.HttpMethodToRoute[httpMethod], self.HttpMethodToRoute[AnyMethod]}
+}
+
 // utility for the node.findRoutes recursive method
 type findContext struct {
-	paramStack []map[string]string
+	paramStack []param
 	matchFunc  func(httpMethod, path string, node *node)
+	// try the literal edges before the placeholders
+	literalFirst bool
+	// set by matchFunc to end the walk
+	stop bool
 }
 
 func newFindContext() *findContext {
 	return &findContext{
-		paramStack: []map[string]string{},
+		paramStack: []param{},
 	}
 }
 
 func (self *findContext) pushParams(name, value string) {
 	self.paramStack = append(
 		self.paramStack,
-		map[string]string{name: value},
+		param{name: name, value: value},
 	)
 }
 
+func (self *findContext) pushIntParams(name, value string, intValue int) {
+	self.paramStack = append(
+		self.paramStack,
+		param{name: name, value: value, isInt: true, intValue: intValue},
+	)
+}
+
+// return true if the value is the one of the referenced param
+func (self *findContext) matchesRef(ref, value string) bool {
+	for _, param := range self.paramStack {
+		if param.name == ref {
+			return param.value == value
+		}
+	}
+	return false
+}
+
 func (self *findContext) popParams() {
 	self.paramStack = self.paramStack[:len(self.paramStack)-1]
 }
@@ -134,15 +268,27 @@ func (self *findContext) popParams() {
 func (self *findContext) paramsAsMap() map[string]string {
 	r := map[string]string{}
 	for _, param := range self.paramStack {
-		for key, value := range param {
-			if r[key] != "" {
-				// this is checked at addRoute time, and should never happen.
-				panic(fmt.Sprintf(
-					"placeholder %s already found, placeholder names should be unique per route",
-					key,
-				))
+		if r[param.name] != "" {
+			// this is checked at addRoute time, and should never happen.
+			panic(fmt.Sprintf(
+				"placeholder %s already found, placeholder names should be unique per route",
+				param.name,
+			))
+		}
+		r[param.name] = param.value
+	}
+	return r
+}
+
+// return the values of the typed params, or nil if there is none
+func (self *findContext) intParamsAsMap() map[string]int {
+	var r map[string]int
+	for _, param := range self.paramStack {
+		if param.isInt {
+			if r == nil {
+				r = map[string]int{}
 			}
-			r[key] = value
+			r[param.name] = param.intValue
 		}
 	}
 	return r
@@ -153,6 +299,8 @@ type Match struct {
 	Route interface{}
 	// map of params matched for this result
 	Params map[string]string
+	// map of the :param:int values matched for this result, nil if none
+	IntParams map[string]int
 }
 
 func (self *node) find(httpMethod, path string, context *findContext) {
@@ -165,24 +313,80 @@ func (self *node) find(httpMethod, path string, context *findContext) {
 		return
 	}
 
-	// *splat branch
-	if self.SplatChild != nil {
+	if context.literalFirst {
+		self.findLiteral(httpMethod, path, context)
+		self.findRefParam(httpMethod, path, context)
+		self.findIntParam(httpMethod, path, context)
+		self.findParam(httpMethod, path, context)
+		self.findSplat(httpMethod, path, context)
+	} else {
+		self.findSplat(httpMethod, path, context)
+		self.findRefParam(httpMethod, path, context)
+		self.findIntParam(httpMethod, path, context)
+		self.findParam(httpMethod, path, context)
+		self.findLiteral(httpMethod, path, context)
+	}
+}
+
+// *splat branch
+func (self *node) findSplat(httpMethod, path string, context *findContext) {
+	if self.SplatChild != nil && !context.stop {
 		context.pushParams(self.SplatName, path)
 		self.SplatChild.find(httpMethod, "", context)
 		context.popParams()
 	}
+}
 
-	// :param branch
-	if self.ParamChild != nil {
+// :param=ref branch
+func (self *node) findRefParam(httpMethod, path string, context *findContext) {
+	if self.RefParamChild != nil && !context.stop {
+		value, remaining := splitParam(path)
+		if context.matchesRef(self.RefParamRef, value) {
+			for _, name := range self.RefParamNames {
+				context.pushParams(name, value)
+			}
+			self.RefParamChild.find(httpMethod, remaining, context)
+			for range self.RefParamNames {
+				context.popParams()
+			}
+		}
+	}
+}
+
+// :param:int branch
+func (self *node) findIntParam(httpMethod, path string, context *findContext) {
+	if self.IntParamChild != nil && !context.stop {
 		value, remaining := splitParam(path)
-		context.pushParams(self.ParamName, value)
+		if intValue, err := strconv.Atoi(value); err == nil {
+			for _, name := range self.IntParamNames {
+				context.pushIntParams(name, value, intValue)
+			}
+			self.IntParamChild.find(httpMethod, remaining, context)
+			for range self.IntParamNames {
+				context.popParams()
+			}
+		}
+	}
+}
+
+// :param branch
+func (self *node) findParam(httpMethod, path string, context *findContext) {
+	if self.ParamChild != nil && !context.stop {
+		value, remaining := splitParam(path)
+		for _, name := range self.ParamNames {
+			context.pushParams(name, value)
+		}
 		self.ParamChild.find(httpMethod, remaining, context)
-		context.popParams()
+		for range self.ParamNames {
+			context.popParams()
+		}
 	}
+}
 
-	// main branch
+// main branch
+func (self *node) findLiteral(httpMethod, path string, context *findContext) {
 	length := self.ChildrenKeyLen
-	if len(path) < length {
+	if len(path) < length || context.stop {
 		return
 	}
 	token := path[0:length]
@@ -192,6 +396,57 @@ func (self *node) find(httpMethod, path string, context *findContext) {
 	}
 }
 
+// Decide if a route matching the path and the http method can be used for the request of the URL,
+// see Trie.FindFirstRoute. Unlike a closure, a func declared at the top level doesn't allocate.
+type RouteFilter func(route interface{}, httpMethod string, urlObj *url.URL) bool
+
+// same walk as find, without capturing the params, return true on the first route
+// matching the http method and accepted by the accept func
+func (self *node) has(httpMethod, path string, accept RouteFilter, urlObj *url.URL) bool {
+
+	if self.HttpMethodToRoute != nil && path == "" {
+		for _, route := range self.methodRoutes(httpMethod) {
+			if route != nil && accept(route, httpMethod, urlObj) {
+				return true
+			}
+		}
+	}
+
+	if len(path) == 0 {
+		return false
+	}
+
+	// *splat branch
+	if self.SplatChild != nil && self.SplatChild.has(httpMethod, "", accept, urlObj) {
+		return true
+	}
+
+	// :param:int branch
+	if self.IntParamChild != nil {
+		value, remaining := splitParam(path)
+		if _, err := strconv.Atoi(value); err == nil && self.IntParamChild.has(httpMethod, remaining, accept, urlObj) {
+			return true
+		}
+	}
+
+	// :param branch
+	if self.ParamChild != nil {
+		_, remaining := splitParam(path)
+		if self.ParamChild.has(httpMethod, remaining, accept, urlObj) {
+			return true
+		}
+	}
+
+	// main branch
+	length := self.ChildrenKeyLen
+	if len(path) < length {
+		return false
+	}
+	token := path[0:length]
+	remaining := path[length:]
+	return self.Children[token] != nil && self.Children[token].has(httpMethod, remaining, accept, urlObj)
+}
+
 func (self *node) compress() {
 	// *splat branch
 	if self.SplatChild != nil {
@@ -201,16 +456,30 @@ func (self *node) compress() {
 	if self.ParamChild != nil {
 		self.ParamChild.compress()
 	}
+	// :param:int branch
+	if self.IntParamChild != nil {
+		self.IntParamChild.compress()
+	}
+	// :param=ref branch
+	if self.RefParamChild != nil {
+		self.RefParamChild.compress()
+	}
 	// main branch
 	if len(self.Children) == 0 {
 		return
 	}
 	// compressable ?
+	// (the children may already be compressed when a route is added after Compress)
 	canCompress := true
+	childrenKeyLen := 0
 	for _, node := range self.Children {
-		if node.HttpMethodToRoute != nil || node.SplatChild != nil || node.ParamChild != nil {
+		if node.HttpMethodToRoute != nil || node.SplatChild != nil || node.ParamChild != nil || node.IntParamChild != nil || node.RefParamChild != nil {
 			canCompress = false
 		}
+		if childrenKeyLen != 0 && node.ChildrenKeyLen != childrenKeyLen {
+			canCompress = false
+		}
+		childrenKeyLen = node.ChildrenKeyLen
 	}
 	// compress
 	if canCompress {
@@ -222,7 +491,7 @@ func (self *node) compress() {
 			}
 		}
 		self.Children = merged
-		self.ChildrenKeyLen++
+		self.ChildrenKeyLen += childrenKeyLen
 		self.compress()
 		// continue
 	} else {
@@ -232,8 +501,71 @@ func (self *node) compress() {
 	}
 }
 
+// call fn for each route of this node and its descendants
+func (self *node) eachRoute(fn func(route interface{})) {
+	for _, route := range self.HttpMethodToRoute {
+		fn(route)
+	}
+	for _, child := range [...]*node{self.SplatChild, self.RefParamChild, self.IntParamChild, self.ParamChild} {
+		if child != nil {
+			child.eachRoute(fn)
+		}
+	}
+	for _, child := range self.Children {
+		child.eachRoute(fn)
+	}
+}
+
+// call fn for each route reached through a branch of a node that the find walk only tries after
+// another branch of the same node, following the order of the walk
+func (self *node) eachBacktrackingRoute(literalFirst bool, fn func(route interface{})) {
+	literals := []*node{}
+	for _, child := range self.Children {
+		literals = append(literals, child)
+	}
+	branches := [][]*node{{self.SplatChild}, {self.RefParamChild}, {self.IntParamChild}, {self.ParamChild}, literals}
+	if literalFirst {
+		branches = [][]*node{literals, {self.RefParamChild}, {self.IntParamChild}, {self.ParamChild}, {self.SplatChild}}
+	}
+	tried := false
+	for _, branch := range branches {
+		for _, child := range branch {
+			if child == nil {
+				continue
+			}
+			if tried {
+				child.eachRoute(fn)
+			} else {
+				child.eachBacktrackingRoute(literalFirst, fn)
+			}
+		}
+		if len(branch) > 0 && branch[0] != nil {
+			tried = true
+		}
+	}
+}
+
+// undo one level of compression, splitting the edges of this node on their first char
+func (self *node) decompress() {
+	split := map[string]*node{}
+	for key, child := range self.Children {
+		head := key[0:1]
+		if split[head] == nil {
+			split[head] = &node{
+				Children:       map[string]*node{},
+				ChildrenKeyLen: self.ChildrenKeyLen - 1,
+			}
+		}
+		split[head].Children[key[1:]] = child
+	}
+	self.Children = split
+	self.ChildrenKeyLen = 1
+}
+
 type Trie struct {
 	root *node
+	// some params reference others, see HasRoute
+	hasRefs bool
 }
 
 // Instanciate a Trie with an empty node as the root.
@@ -244,8 +576,112 @@ func NewTrie() *Trie {
 }
 
 // Insert the route in the Trie following or creating the nodes corresponding to the path.
+// On a compressed Trie, only the compressed edges on the way of the path are split and compressed again.
 func (self *Trie) AddRoute(httpMethod, pathExp string, route interface{}) error {
-	return self.root.addRoute(httpMethod, pathExp, route, []string{})
+	err := self.root.addRoute(httpMethod, pathExp, route, []string{})
+	if err == nil && strings.IndexByte(pathExp, '=') != -1 {
+		self.hasRefs = true
+	}
+	return err
+}
+
+// A route to insert in the Trie, see AddRoutesConcurrently.
+type TrieRoute struct {
+	HttpMethod string
+	PathExp    string
+	Route      interface{}
+}
+
+// Insert the routes like AddRoute in the given order, but build the sub-tries of the paths
+// starting with different literal characters after "/" concurrently, and merge them under
+// the root. The other paths, like "/:id", are inserted serially. The Trie must be empty.
+// The resulting Trie is identical to the one of the serial inserts, and on errors the one
+// of the earliest route in the slice is returned, like the serial inserts would.
+func (self *Trie) AddRoutesConcurrently(routes []TrieRoute) error {
+
+	// partition the routes by the first literal character after "/"
+	partitions := map[byte][]int{}
+	shared := []int{}
+	for i, route := range routes {
+		pathExp := route.PathExp
+		if len(pathExp) < 2 || pathExp[0] != '/' || pathExp[1] == ':' || pathExp[1] == '*' {
+			shared = append(shared, i)
+			continue
+		}
+		partitions[pathExp[1]] = append(partitions[pathExp[1]], i)
+	}
+
+	// build a sub-trie per partition, stopping at its first failing route
+	subTries := map[byte]*Trie{}
+	failures := map[int]error{}
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	for key, indexes := range partitions {
+		wg.Add(1)
+		go func(key byte, indexes []int) {
+			defer wg.Done()
+			subTrie := NewTrie()
+			for _, i := range indexes {
+				err := subTrie.AddRoute(routes[i].HttpMethod, routes[i].PathExp, routes[i].Route)
+				if err != nil {
+					lock.Lock()
+					failures[i] = err
+					lock.Unlock()
+					return
+				}
+			}
+			lock.Lock()
+			subTries[key] = subTrie
+			lock.Unlock()
+		}(key, indexes)
+	}
+
+	// meanwhile insert the shared routes
+	for _, i := range shared {
+		err := self.AddRoute(routes[i].HttpMethod, routes[i].PathExp, routes[i].Route)
+		if err != nil {
+			lock.Lock()
+			failures[i] = err
+			lock.Unlock()
+			break
+		}
+	}
+	wg.Wait()
+
+	// report the error of the earliest route
+	firstFailed := -1
+	for i := range failures {
+		if firstFailed == -1 || i < firstFailed {
+			firstFailed = i
+		}
+	}
+	if firstFailed != -1 {
+		return failures[firstFailed]
+	}
+
+	// merge the sub-tries under the root
+	if len(subTries) == 0 {
+		return nil
+	}
+	if self.root.Children == nil {
+		self.root.Children = map[string]*node{}
+		self.root.ChildrenKeyLen = 1
+	}
+	slashNode := self.root.Children["/"]
+	if slashNode == nil {
+		slashNode = &node{}
+		self.root.Children["/"] = slashNode
+	}
+	if slashNode.Children == nil {
+		slashNode.Children = map[string]*node{}
+		slashNode.ChildrenKeyLen = 1
+	}
+	for key, subTrie := range subTries {
+		slashNode.Children[string(key)] = subTrie.root.Children["/"].Children[string(key)]
+		self.hasRefs = self.hasRefs || subTrie.hasRefs
+	}
+
+	return nil
 }
 
 // Given a path and an http method, return all the matching routes.
@@ -253,15 +689,18 @@ func (self *Trie) FindRoutes(httpMethod, path string) []*Match {
 	context := newFindContext()
 	matches := []*Match{}
 	context.matchFunc = func(httpMethod, path string, node *node) {
-		if node.HttpMethodToRoute[httpMethod] != nil {
-			// path and method match, found a route !
-			matches = append(
-				matches,
-				&Match{
-					Route:  node.HttpMethodToRoute[httpMethod],
-					Params: context.paramsAsMap(),
-				},
-			)
+		for _, route := range node.methodRoutes(httpMethod) {
+			if route != nil {
+				// path and method match, found a route !
+				matches = append(
+					matches,
+					&Match{
+						Route:     route,
+						Params:    context.paramsAsMap(),
+						IntParams: context.intParamsAsMap(),
+					},
+				)
+			}
 		}
 	}
 	self.root.find(httpMethod, path, context)
@@ -276,33 +715,74 @@ func (self *Trie) FindRoutesAndPathMatched(httpMethod, path string) ([]*Match, b
 	matches := []*Match{}
 	context.matchFunc = func(httpMethod, path string, node *node) {
 		pathMatched = true
-		if node.HttpMethodToRoute[httpMethod] != nil {
-			// path and method match, found a route !
-			matches = append(
-				matches,
-				&Match{
-					Route:  node.HttpMethodToRoute[httpMethod],
-					Params: context.paramsAsMap(),
-				},
-			)
+		for _, route := range node.methodRoutes(httpMethod) {
+			if route != nil {
+				// path and method match, found a route !
+				matches = append(
+					matches,
+					&Match{
+						Route:     route,
+						Params:    context.paramsAsMap(),
+						IntParams: context.intParamsAsMap(),
+					},
+				)
+			}
 		}
 	}
 	self.root.find(httpMethod, path, context)
 	return matches, pathMatched
 }
 
+// Given a path and an http method, walk the literal edges before the placeholders and return the
+// first matching route accepted by the accept func, and a boolean indicating if the path was matched.
+func (self *Trie) FindFirstRoute(httpMethod, path string, accept RouteFilter, urlObj *url.URL) (*Match, bool) {
+	context := newFindContext()
+	context.literalFirst = true
+	pathMatched := false
+	var match *Match
+	context.matchFunc = func(httpMethod, path string, node *node) {
+		pathMatched = true
+		for _, route := range node.methodRoutes(httpMethod) {
+			if route != nil && accept(route, httpMethod, urlObj) {
+				match = &Match{
+					Route:     route,
+					Params:    context.paramsAsMap(),
+					IntParams: context.intParamsAsMap(),
+				}
+				context.stop = true
+				return
+			}
+		}
+	}
+	self.root.find(httpMethod, path, context)
+	return match, pathMatched
+}
+
+// Given a path and an http method, return true if a matching route is accepted by the accept func.
+// The params are not captured, so this doesn't allocate, unless some params reference others
+// and have to be captured to be compared.
+func (self *Trie) HasRoute(httpMethod, path string, accept RouteFilter, urlObj *url.URL) bool {
+	if self.hasRefs {
+		match, _ := self.FindFirstRoute(httpMethod, path, accept, urlObj)
+		return match != nil
+	}
+	return self.root.has(httpMethod, path, accept, urlObj)
+}
+
 // Given a path, and whatever the http method, return all the matching routes.
 func (self *Trie) FindRoutesForPath(path string) []*Match {
 	context := newFindContext()
 	matches := []*Match{}
 	context.matchFunc = func(httpMethod, path string, node *node) {
 		params := context.paramsAsMap()
+		intParams := context.intParamsAsMap()
 		for _, route := range node.HttpMethodToRoute {
 			matches = append(
 				matches,
 				&Match{
-					Route:  route,
-					Params: params,
+					Route:     route,
+					Params:    params,
+					IntParams: intParams,
 				},
 			)
 		}
@@ -311,7 +791,7 @@ func (self *Trie) FindRoutesForPath(path string) []*Match {
 	return matches
 }
 
-// Reduce the size of the tree, must be done after the last AddRoute.
+// Reduce the size of the tree, best done after the last AddRoute.
 func (self *Trie) Compress() {
 	self.root.compress()
 }
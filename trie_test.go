@@ -0,0 +1,173 @@
+package route
+
+import (
+	"fmt"
+	"sort"
+	"testing"
+)
+
+var compressTestRoutes = []string{
+	"/users",
+	"/users/:id",
+	"/users/:id/posts",
+	"/users/:id/posts/:post",
+	"/userinfo",
+	"/useless/*rest",
+	"/products/list",
+	"/products/latest",
+	"/producers/:name",
+	"/static/css/*file",
+	"/static/js/app.js",
+	"/statistics",
+}
+
+var compressTestPaths = []string{
+	"/users",
+	"/users/5",
+	"/users/5/posts",
+	"/users/5/posts/7",
+	"/userinfo",
+	"/useless/a/b",
+	"/products/list",
+	"/products/latest",
+	"/products/lat",
+	"/producers/acme",
+	"/static/css/site.css",
+	"/static/js/app.js",
+	"/statistics",
+	"/stat",
+	"/nothing",
+}
+
+// describe the matches of the path, for comparing two tries
+func describeMatches(trie *Trie, path string) string {
+	described := []string{}
+	for _, match := range trie.FindRoutes("GET", path) {
+		described = append(described, fmt.Sprintf("%v %v", match.Route, match.Params))
+	}
+	sort.Strings(described)
+	return fmt.Sprint(described)
+}
+
+func TestAddRouteAfterCompress(t *testing.T) {
+
+	expected := NewTrie()
+	for _, pathExp := range compressTestRoutes {
+		if err := expected.AddRoute("GET", pathExp, pathExp); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expected.Compress()
+
+	// add the first half, compress, then add the rest one by one
+	trie := NewTrie()
+	half := len(compressTestRoutes) / 2
+	for _, pathExp := range compressTestRoutes[:half] {
+		if err := trie.AddRoute("GET", pathExp, pathExp); err != nil {
+			t.Fatal(err)
+		}
+	}
+	trie.Compress()
+	for _, pathExp := range compressTestRoutes[half:] {
+		if err := trie.AddRoute("GET", pathExp, pathExp); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, path := range compressTestPaths {
+		if got, want := describeMatches(trie, path), describeMatches(expected, path); got != want {
+			t.Errorf("%s: expected %s, got %s", path, want, got)
+		}
+	}
+
+	if err := trie.AddRoute("GET", "/users/:id", "again"); err == nil {
+		t.Error("expected a duplicated route to be rejected after Compress")
+	}
+}
+
+// the routes of a large table, and the ones added to it afterwards
+func largeTable() ([]string, []string) {
+	table := []string{}
+	for i := 0; i < 10000; i++ {
+		table = append(table, fmt.Sprintf("/resources%d/:id/items", i))
+	}
+	added := []string{}
+	for i := 0; i < 10; i++ {
+		added = append(added, fmt.Sprintf("/resources%d/:id/extra", i*1000))
+	}
+	return table, added
+}
+
+func compressedTrie(pathExps []string) *Trie {
+	trie := NewTrie()
+	for _, pathExp := range pathExps {
+		trie.AddRoute("GET", pathExp, pathExp)
+	}
+	trie.Compress()
+	return trie
+}
+
+func BenchmarkAddRouteAfterCompress(b *testing.B) {
+	table, added := largeTable()
+	for n := 0; n < b.N; n++ {
+		b.StopTimer()
+		trie := compressedTrie(table)
+		b.StartTimer()
+		for _, pathExp := range added {
+			trie.AddRoute("GET", pathExp, pathExp)
+		}
+	}
+}
+
+// the full rebuild and recompress of the table for each added route
+func BenchmarkAddRouteWithFullRecompress(b *testing.B) {
+	table, added := largeTable()
+	for n := 0; n < b.N; n++ {
+		pathExps := table
+		for _, pathExp := range added {
+			pathExps = append(pathExps, pathExp)
+			compressedTrie(pathExps)
+		}
+	}
+}
+
+func TestAddRoutesConcurrently(t *testing.T) {
+
+	routes := []TrieRoute{}
+	serial := NewTrie()
+	for _, pathExp := range append(compressTestRoutes, "/:lang/home", "/*all") {
+		routes = append(routes, TrieRoute{"GET", pathExp, pathExp})
+		if err := serial.AddRoute("GET", pathExp, pathExp); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	trie := NewTrie()
+	if err := trie.AddRoutesConcurrently(routes); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range append(compressTestPaths, "/en/home") {
+		if got, want := describeMatches(trie, path), describeMatches(serial, path); got != want {
+			t.Errorf("%s: expected %s, got %s", path, want, got)
+		}
+	}
+
+	// the error of the earliest route, like the serial inserts
+	routes = []TrieRoute{
+		{"GET", "/users/:id", 1},
+		{"GET", "/posts/:id", 2},
+		{"GET", "/posts/:id", 3},
+		{"GET", "/users/:id", 4},
+	}
+	expected := NewTrie()
+	var serialErr error
+	for _, route := range routes {
+		if serialErr = expected.AddRoute(route.HttpMethod, route.PathExp, route.Route); serialErr != nil {
+			break
+		}
+	}
+	err := NewTrie().AddRoutesConcurrently(routes)
+	if err == nil || serialErr == nil || err.Error() != serialErr.Error() {
+		t.Errorf("expected the error %v, got: %v", serialErr, err)
+	}
+}